@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/handlers"
+)
+
+// A StatusReport is the radio's readiness and what it records
+type StatusReport struct {
+	HealthReport
+	Recording []string `json:"recording"`
+}
+
+// Status reports the readiness of the radio and the stations recording
+func (r *Radio) Status(rw http.ResponseWriter, req *http.Request) {
+	report := StatusReport{
+		HealthReport: r.Readiness(req.Context(), time.Now()),
+		Recording:    []string{},
+	}
+
+	r.mu.Lock()
+	for name := range r.recording {
+		report.Recording = append(report.Recording, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(report.Recording)
+
+	writeJSON(rw, http.StatusOK, report)
+}
+
+// publicHandler serves listeners, who can stream stations,
+// list presets at a limited rate and see tape coverage,
+// and health probes
+func (r *Radio) publicHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", r.Healthz)
+	mux.HandleFunc("/readyz", r.Readyz)
+
+	// simple healthcheck
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	if !r.Options.Broadcast {
+		return mux
+	}
+
+	if r.PresetLimit != nil {
+		presets := http.NewServeMux()
+		r.Presets.RegisterServiceHandlers(r.PathPreset, presets)
+		mux.Handle(r.PathPreset, r.PresetLimit.Limit(r.clientIP, presets))
+	} else {
+		r.Presets.RegisterServiceHandlers(r.PathPreset, mux)
+	}
+	mux.HandleFunc(r.PathBroadcast, r.Broadcast)
+
+	// enable cors
+	cors := handlers.CORS(
+		handlers.AllowedHeaders([]string{"Content-Type", "X-API-Key"}),
+		handlers.AllowedMethods([]string{"GET"}),
+		handlers.AllowedOrigins(r.Options.CORSOrigins))
+	return cors(mux)
+}
+
+// adminHandler serves preset and api key management, url signing,
+// status, tape coverage, metrics and profiling to requests bearing
+// the admin token
+func (r *Radio) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	r.Presets.RegisterAdminHandlers(r.PathPreset, mux)
+	mux.HandleFunc("/status", r.Status)
+	mux.HandleFunc(r.PathTapes, r.Coverage)
+	mux.Handle("/metrics", registry)
+	if r.Auth != nil {
+		r.Auth.RegisterAdminHandlers(mux)
+	}
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return requireToken(r.AdminToken, mux)
+}
+
+// requireToken rejects requests without the bearer token
+func requireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		bearer := strings.TrimPrefix(auth, "Bearer ")
+		if token == "" || bearer == auth ||
+			subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeJSON(rw, http.StatusUnauthorized, &PathError{Err: "missing or invalid admin token"})
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
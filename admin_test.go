@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	p, _ := PresetsWithBackend(&testPresetBackend{data: make(map[string][]byte)})
+	r := &Radio{
+		Presets:    p,
+		TapeDeck:   &TapeDeck{backend: &testTapeBackend{}},
+		Options:    RadioOptions{Broadcast: true},
+		AdminToken: "sekrit",
+
+		PathBroadcast: "/listen/",
+		PathPreset:    "/preset/",
+		PathTapes:     "/tapes/",
+	}
+	admin, public := r.adminHandler(), r.publicHandler()
+
+	ats := []struct {
+		method, path, token, body string
+		status                    int
+	}{
+		{"GET", "/status", "", "", http.StatusUnauthorized},
+		{"GET", "/status", "wrong", "", http.StatusUnauthorized},
+		{"GET", "/status", "sekrit", "", http.StatusOK},
+		{"GET", "/metrics", "sekrit", "", http.StatusOK},
+		{"GET", "/debug/pprof/", "sekrit", "", http.StatusOK},
+		{"GET", "/tapes/wamc/coverage", "", "", http.StatusUnauthorized},
+		{"POST", "/preset/add", "sekrit", tsjson, http.StatusOK},
+		{"GET", "/tapes/wamc/coverage", "sekrit", "", http.StatusOK},
+		{"GET", "/preset/add", "sekrit", "", http.StatusMethodNotAllowed},
+		{"POST", "/preset/add", "sekrit", `{"name":"kexp"}`, http.StatusBadRequest},
+		{"POST", "/preset/add", "sekrit", `{"name":"kexp","url":"http://kexp","location":"Seattle"}`, http.StatusBadRequest},
+	}
+	for _, at := range ats {
+		req := httptest.NewRequest(at.method, at.path, strings.NewReader(at.body))
+		if at.token != "" {
+			req.Header.Set("Authorization", "Bearer "+at.token)
+		}
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		if rec.Code != at.status {
+			t.Errorf("%s %s status wrong. expected %d, got %d", at.method, at.path, at.status, rec.Code)
+		}
+	}
+
+	if _, err := p.Lookup("wamc"); err != nil {
+		t.Errorf("added preset not found: %v", err)
+	}
+
+	// the public server only lists presets
+	for _, path := range []string{"/preset/add", "/status", "/tapes/wamc/coverage", "/metrics", "/debug/pprof/"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(tsjson))
+		req.Header.Set("Authorization", "Bearer sekrit")
+		public.ServeHTTP(rec, req)
+		if rec.Code == http.StatusOK && rec.Body.Len() > 0 {
+			t.Errorf("%s served publicly: %s", path, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	public.ServeHTTP(rec, httptest.NewRequest("GET", "/preset/list", nil))
+	var resp listResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || len(resp.Presets) != 1 {
+		t.Errorf("public preset list wrong: %+v, %v", resp, err)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	h := requireToken("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest("GET", "/status", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("empty token accepted")
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// Listener names for streams without an api key naming them
+const (
+	anonymousListener = "anonymous"
+	signedListener    = "signed"
+)
+
+// MinSigningKey is the shortest key urls are signed with
+const MinSigningKey = 16
+
+// MaxSignedURLTTL bounds how long the admin server signs urls for
+const MaxSignedURLTTL = 7 * 24 * time.Hour
+
+// An APIKey lets a listener stream stations. Keys are stored under
+// the hash of their secret, so the database never holds the secret
+type APIKey struct {
+	Name     string   `json:"name"`
+	Stations []string `json:"stations,omitempty"` // every station if empty
+	Disabled bool     `json:"disabled,omitempty"`
+}
+
+// Allows reports whether the key may stream the station
+func (k APIKey) Allows(station string) bool {
+	if len(k.Stations) == 0 {
+		return true
+	}
+	for _, s := range k.Stations {
+		if s == station {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrKeyNotFound is returned by key backends for hashes
+// that no api key is stored under
+var ErrKeyNotFound = errors.New("api key not found")
+
+// A KeyBackend stores api keys by the hash of their secret
+type KeyBackend interface {
+	ReadKey(hash string) (data []byte, err error)
+	WriteKey(hash string, data []byte) error
+}
+
+// HashKey returns the hash an api key's secret is stored under
+func HashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// An AuthError rejects a listener, with its kind counted in metrics.
+// The listener is told the reason, but not the backend's error
+type AuthError struct {
+	Status int
+	Kind   string // missing|invalid|expired|forbidden|unavailable
+	Reason string
+	Err    error
+}
+
+func (e *AuthError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+	}
+	return e.Reason
+}
+
+// ListenerAuth checks listeners' api keys and signed urls
+type ListenerAuth struct {
+	Keys     KeyBackend // nil to refuse api keys
+	Secret   []byte     // signs urls, nil to refuse signed urls
+	Required bool       // refuse listeners with neither
+}
+
+// Authenticate names the listener streaming the station, from an api
+// key in the X-API-Key header or key parameter, or from a signed url,
+// and reports whether the url was signed
+func (a *ListenerAuth) Authenticate(req *http.Request, station string, now time.Time) (string, bool, *AuthError) {
+	q := req.URL.Query()
+	if q.Get("sig") != "" {
+		listener, err := a.verifySigned(req.URL.Path, q, now)
+		return listener, true, err
+	}
+
+	secret := req.Header.Get("X-API-Key")
+	if secret == "" {
+		secret = q.Get("key")
+	}
+	if secret != "" {
+		listener, err := a.verifyKey(secret, station)
+		return listener, false, err
+	}
+
+	if a.Required {
+		return "", false, &AuthError{http.StatusUnauthorized, "missing", "an api key or signed url is required", nil}
+	}
+	return anonymousListener, false, nil
+}
+
+func (a *ListenerAuth) verifySigned(path string, q url.Values, now time.Time) (string, *AuthError) {
+	if a.Secret == nil {
+		return "", &AuthError{http.StatusUnauthorized, "invalid", "signed urls are not accepted", nil}
+	}
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return "", &AuthError{http.StatusUnauthorized, "invalid", "signed url has no expiry", nil}
+	}
+	sig, err := hex.DecodeString(q.Get("sig"))
+	client := q.Get("client")
+	if err != nil || !hmac.Equal(sig, signature(a.Secret, path, client, expires)) {
+		return "", &AuthError{http.StatusUnauthorized, "invalid", "signed url has a bad signature", nil}
+	}
+	if now.Unix() > expires {
+		return "", &AuthError{http.StatusUnauthorized, "expired", "signed url has expired", nil}
+	}
+
+	if client == "" {
+		client = signedListener
+	}
+	return client, nil
+}
+
+func (a *ListenerAuth) verifyKey(secret, station string) (string, *AuthError) {
+	if a.Keys == nil {
+		return "", &AuthError{http.StatusUnauthorized, "invalid", "api keys are not accepted", nil}
+	}
+	data, err := a.Keys.ReadKey(HashKey(secret))
+	if err == ErrKeyNotFound {
+		return "", &AuthError{http.StatusUnauthorized, "invalid", "unknown api key", nil}
+	}
+	if err != nil {
+		return "", &AuthError{http.StatusServiceUnavailable, "unavailable", "cannot check api key", err}
+	}
+	var k APIKey
+	if err := json.Unmarshal(data, &k); err != nil {
+		return "", &AuthError{http.StatusUnauthorized, "invalid", "unreadable api key", nil}
+	}
+
+	if k.Disabled {
+		return k.Name, &AuthError{http.StatusForbidden, "forbidden", "api key is disabled", nil}
+	}
+	if !k.Allows(station) {
+		return k.Name, &AuthError{http.StatusForbidden, "forbidden", fmt.Sprintf("api key cannot stream %s", station), nil}
+	}
+	return k.Name, nil
+}
+
+// signature signs a url path for a client until it expires
+func signature(secret []byte, path, client string, expires int64) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", path, client, expires)
+	return mac.Sum(nil)
+}
+
+// SignURL returns a path with the parameters that let a client stream
+// it until it expires. The signature is the hex HMAC-SHA256 of the
+// path, client and unix expiry time, separated by newlines
+func SignURL(secret []byte, path, client string, expires time.Time) string {
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	if client != "" {
+		q.Set("client", client)
+	}
+	q.Set("sig", hex.EncodeToString(signature(secret, path, client, expires.Unix())))
+	return path + "?" + q.Encode()
+}
+
+// AddKey creates an api key and returns its secret
+func (a *ListenerAuth) AddKey(k APIKey) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(b)
+
+	data, err := json.Marshal(k)
+	if err != nil {
+		return "", err
+	}
+	return secret, a.Keys.WriteKey(HashKey(secret), data)
+}
+
+// DisableKey stops the api key stored under the hash from streaming
+func (a *ListenerAuth) DisableKey(hash string) error {
+	data, err := a.Keys.ReadKey(hash)
+	if err != nil {
+		return err
+	}
+	var k APIKey
+	if err := json.Unmarshal(data, &k); err != nil {
+		return err
+	}
+	k.Disabled = true
+	if data, err = json.Marshal(k); err != nil {
+		return err
+	}
+	return a.Keys.WriteKey(hash, data)
+}
+
+// RegisterAdminHandlers serves api key management and url signing
+func (a *ListenerAuth) RegisterAdminHandlers(mux *http.ServeMux) {
+	if a.Keys != nil {
+		mux.HandleFunc("/keys/add", a.handleAddKey)
+		mux.HandleFunc("/keys/disable", a.handleDisableKey)
+	}
+	if a.Secret != nil {
+		mux.HandleFunc("/sign", a.handleSign)
+	}
+}
+
+// handleAddKey creates the posted api key, replying with the secret
+// listeners present and the hash that identifies the key
+func (a *ListenerAuth) handleAddKey(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSON(rw, http.StatusMethodNotAllowed, &PathError{Err: "keys are added with a POST"})
+		return
+	}
+	var k APIKey
+	if err := json.NewDecoder(req.Body).Decode(&k); err != nil || k.Name == "" {
+		writeJSON(rw, http.StatusBadRequest, &PathError{Err: "key needs a name"})
+		return
+	}
+
+	secret, err := a.AddKey(k)
+	if err != nil {
+		level.Warn(logger).Log(
+			"msg", "Cannot add api key",
+			"listener", k.Name,
+			"err", err)
+		writeJSON(rw, http.StatusBadGateway, &PathError{Err: "backend error"})
+		return
+	}
+	writeJSON(rw, http.StatusOK, struct {
+		APIKey
+		Key  string `json:"key"`
+		Hash string `json:"hash"`
+	}{k, secret, HashKey(secret)})
+}
+
+// handleDisableKey disables the api key with the posted hash
+func (a *ListenerAuth) handleDisableKey(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSON(rw, http.StatusMethodNotAllowed, &PathError{Err: "keys are disabled with a POST"})
+		return
+	}
+	var body struct {
+		Hash string `json:"hash"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Hash == "" {
+		writeJSON(rw, http.StatusBadRequest, &PathError{Err: "missing key hash"})
+		return
+	}
+	if err := a.DisableKey(body.Hash); err == ErrKeyNotFound {
+		writeJSON(rw, http.StatusNotFound, &PathError{Err: "key not found"})
+		return
+	} else if err != nil {
+		level.Warn(logger).Log(
+			"msg", "Cannot disable api key",
+			"hash", body.Hash,
+			"err", err)
+		writeJSON(rw, http.StatusBadGateway, &PathError{Err: "backend error"})
+		return
+	}
+	writeJSON(rw, http.StatusOK, struct {
+		Hash     string `json:"hash"`
+		Disabled bool   `json:"disabled"`
+	}{body.Hash, true})
+}
+
+// handleSign signs the path parameter for the client parameter,
+// for the ttl parameter or an hour
+func (a *ListenerAuth) handleSign(rw http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	path := q.Get("path")
+	if path == "" {
+		writeJSON(rw, http.StatusBadRequest, &PathError{Err: "missing path"})
+		return
+	}
+	ttl := time.Hour
+	if v := q.Get("ttl"); v != "" {
+		var err error
+		if ttl, err = time.ParseDuration(v); err != nil || ttl <= 0 || ttl > MaxSignedURLTTL {
+			writeJSON(rw, http.StatusBadRequest, &PathError{Err: fmt.Sprintf("ttl must be a duration up to %s", MaxSignedURLTTL)})
+			return
+		}
+	}
+
+	expires := time.Now().Add(ttl)
+	writeJSON(rw, http.StatusOK, struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}{SignURL(a.Secret, path, q.Get("client"), expires), expires.UTC()})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testKeyBackend struct {
+	data map[string][]byte
+	err  error
+}
+
+func (b *testKeyBackend) ReadKey(hash string) ([]byte, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	data, ok := b.data[hash]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return data, nil
+}
+
+func (b *testKeyBackend) WriteKey(hash string, data []byte) error {
+	b.data[hash] = data
+	return nil
+}
+
+func TestListenerAuth(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	a := &ListenerAuth{
+		Keys:     &testKeyBackend{data: make(map[string][]byte)},
+		Secret:   secret,
+		Required: true,
+	}
+	all, _ := a.AddKey(APIKey{Name: "app"})
+	wamc, _ := a.AddKey(APIKey{Name: "wamc-only", Stations: []string{"wamc"}})
+	gone, _ := a.AddKey(APIKey{Name: "gone"})
+	if err := a.DisableKey(HashKey(gone)); err != nil {
+		t.Fatalf("DisableKey failed, %v", err)
+	}
+
+	now := time.Date(2017, 7, 30, 3, 0, 0, 0, time.UTC)
+	signed := SignURL(secret, "/listen/kexp/America/New_York", "player", now.Add(time.Hour))
+
+	ats := []struct {
+		url, header string
+		listener    string
+		status      int
+	}{
+		{"/listen/kexp", "", "", http.StatusUnauthorized},
+		{"/listen/kexp?key=" + all, "", "app", 0},
+		{"/listen/kexp", all, "app", 0},
+		{"/listen/kexp?key=nope", "", "", http.StatusUnauthorized},
+		{"/listen/wamc?key=" + wamc, "", "wamc-only", 0},
+		{"/listen/kexp?key=" + wamc, "", "wamc-only", http.StatusForbidden},
+		{"/listen/kexp?key=" + gone, "", "gone", http.StatusForbidden},
+		{signed, "", "player", 0},
+		{strings.Replace(signed, "kexp", "wamc", 1), "", "", http.StatusUnauthorized},
+		{strings.Replace(signed, "player", "other", 1), "", "", http.StatusUnauthorized},
+	}
+	for _, at := range ats {
+		req := httptest.NewRequest("GET", at.url, nil)
+		if at.header != "" {
+			req.Header.Set("X-API-Key", at.header)
+		}
+		station := strings.Split(strings.TrimPrefix(req.URL.Path, "/listen/"), "/")[0]
+		listener, isSigned, err := a.Authenticate(req, station, now)
+		status := 0
+		if err != nil {
+			status = err.Status
+		}
+		if status != at.status || listener != at.listener {
+			t.Errorf("%s authenticated wrong. expected %q %d, got %q %d (%v)",
+				at.url, at.listener, at.status, listener, status, err)
+		}
+		if isSigned != strings.Contains(at.url, "sig=") {
+			t.Errorf("%s signed wrong, got %v", at.url, isSigned)
+		}
+	}
+
+	req := httptest.NewRequest("GET", signed, nil)
+	if _, _, err := a.Authenticate(req, "kexp", now.Add(2*time.Hour)); err == nil || err.Kind != "expired" {
+		t.Errorf("expired signed url accepted: %v", err)
+	}
+
+	// a failing backend doesn't reject keys as unknown
+	backendErr := errors.New("connection refused")
+	a.Keys.(*testKeyBackend).err = backendErr
+	req = httptest.NewRequest("GET", "/listen/kexp?key="+all, nil)
+	if _, _, err := a.Authenticate(req, "kexp", now); err == nil || err.Status != http.StatusServiceUnavailable || err.Err != backendErr {
+		t.Errorf("key checked without the backend: %v", err)
+	}
+	a.Keys.(*testKeyBackend).err = nil
+
+	a.Required = false
+	req = httptest.NewRequest("GET", "/listen/kexp", nil)
+	if listener, _, err := a.Authenticate(req, "kexp", now); err != nil || listener != anonymousListener {
+		t.Errorf("anonymous listener refused: %v", err)
+	}
+}
+
+func TestAuthAdminHandlers(t *testing.T) {
+	keys := &testKeyBackend{data: make(map[string][]byte)}
+	a := &ListenerAuth{Keys: keys, Secret: []byte("0123456789abcdef")}
+	mux := http.NewServeMux()
+	a.RegisterAdminHandlers(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("POST", "/keys/add", strings.NewReader(`{"name":"app","stations":["wamc"]}`)))
+	var added struct {
+		Key, Hash string
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&added); err != nil || added.Key == "" {
+		t.Fatalf("key not added: %d, %v", rec.Code, err)
+	}
+	if added.Hash != HashKey(added.Key) || keys.data[added.Hash] == nil {
+		t.Errorf("key not stored under its hash")
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("POST", "/keys/disable", strings.NewReader(`{"hash":"`+added.Hash+`"}`)))
+	req := httptest.NewRequest("GET", "/listen/wamc?key="+added.Key, nil)
+	if _, _, err := a.Authenticate(req, "wamc", time.Now()); rec.Code != http.StatusOK || err == nil {
+		t.Errorf("key not disabled: %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("POST", "/keys/disable", strings.NewReader(`{"hash":"nope"}`)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown key disabled: %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/sign?path=/listen/wamc&ttl=10m&client=app", nil))
+	var signed struct{ URL string }
+	if err := json.NewDecoder(rec.Body).Decode(&signed); err != nil {
+		t.Fatalf("url not signed: %d, %v", rec.Code, err)
+	}
+	req = httptest.NewRequest("GET", signed.URL, nil)
+	if listener, _, err := a.Authenticate(req, "wamc", time.Now()); err != nil || listener != "app" {
+		t.Errorf("signed url refused: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/sign?path=/listen/wamc&ttl=forever", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("bad ttl accepted")
+	}
+}
@@ -1,5 +1,14 @@
 package main
 
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 type Backend interface {
 	Initable
 }
@@ -8,3 +17,188 @@ type Backend interface {
 type Initable interface {
 	Init() error
 }
+
+// Ping checks that the backend is reachable
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// A Capability is something a driver's backends can do
+type Capability uint
+
+const (
+	// CapPresets backends implement PresetBackend
+	CapPresets Capability = 1 << iota
+	// CapTapes backends implement TapeBackend
+	CapTapes
+	// CapTTL backends expire chunks on their own, others
+	// implement Sweeper to delete them
+	CapTTL
+	// CapListing backends page through presets and list chunks
+	// without scanning everything they store
+	CapListing
+	// CapWatch backends notify of preset changes
+	CapWatch
+	// CapKeys backends implement KeyBackend
+	CapKeys
+)
+
+var capabilityNames = []string{"presets", "tapes", "ttl", "listing", "watch", "keys"}
+
+func (c Capability) String() string {
+	var names []string
+	for i, name := range capabilityNames {
+		if c&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// A Driver opens backends of one kind
+type Driver struct {
+	Name         string
+	Capabilities Capability
+
+	// Settings are the config keys the driver reads
+	Settings []string
+
+	// Schemes are the url schemes of the driver's backends
+	Schemes []string
+
+	// Validate checks the driver's settings, if it needs more
+	// than the checks every config gets
+	Validate func(c *Config) []error
+
+	// Open returns a backend configured by the config,
+	// and FromURL one configured by a url. Neither is
+	// initialized
+	Open    func(c *Config) (Backend, error)
+	FromURL func(u *url.URL) (Backend, error)
+}
+
+// Has reports whether the driver has every capability in c
+func (d *Driver) Has(c Capability) bool {
+	return d.Capabilities&c == c
+}
+
+// capabilityInterfaces are the interfaces a backend must
+// implement for its driver to declare each capability
+var capabilityInterfaces = []struct {
+	c    Capability
+	name string
+	ok   func(b Backend) bool
+}{
+	{CapPresets, "PresetBackend", func(b Backend) bool { _, ok := b.(PresetBackend); return ok }},
+	{CapTapes, "TapeBackend", func(b Backend) bool { _, ok := b.(TapeBackend); return ok }},
+	{CapWatch, "PresetWatcher", func(b Backend) bool { _, ok := b.(PresetWatcher); return ok }},
+	{CapKeys, "KeyBackend", func(b Backend) bool { _, ok := b.(KeyBackend); return ok }},
+}
+
+// check returns an error if the backend lacks an interface
+// for one of the driver's capabilities
+func (d *Driver) check(b Backend) error {
+	for _, i := range capabilityInterfaces {
+		if d.Has(i.c) && !i.ok(b) {
+			return fmt.Errorf("the %s driver has %s but its backend does not implement %s", d.Name, i.c, i.name)
+		}
+	}
+	if d.Has(CapTapes) && !d.Has(CapTTL) {
+		if _, ok := b.(Sweeper); !ok {
+			return fmt.Errorf("the %s driver has no ttl but its backend does not implement Sweeper", d.Name)
+		}
+	}
+	return nil
+}
+
+// drivers are the registered drivers by name
+var drivers = map[string]*Driver{}
+
+// RegisterDriver makes a driver available by its name, and
+// should be called by the driver's init
+func RegisterDriver(d *Driver) {
+	if _, ok := drivers[d.Name]; ok {
+		panic(fmt.Sprintf("driver %s registered twice", d.Name))
+	}
+	drivers[d.Name] = d
+}
+
+// LookupDriver returns the registered driver with the name
+func LookupDriver(name string) (*Driver, bool) {
+	d, ok := drivers[name]
+	return d, ok
+}
+
+// DriverNames returns the names of the drivers with every
+// capability in c, in order
+func DriverNames(c Capability) []string {
+	var names []string
+	for name, d := range drivers {
+		if d.Has(c) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenDriver returns an initialized backend from the named driver,
+// which must implement the interfaces of the driver's capabilities
+func OpenDriver(name string, c *Config) (Backend, error) {
+	d, ok := LookupDriver(name)
+	if !ok {
+		return nil, fmt.Errorf("no %q driver found", name)
+	}
+	b, err := d.Open(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.check(b); err != nil {
+		return nil, err
+	}
+	if err := b.Init(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// BackendFromURL returns an initialized backend and its driver for
+// a url with one of the drivers' schemes, like redis://host:6379/0,
+// gcs://bucket or datastore://project
+func BackendFromURL(raw string) (Backend, *Driver, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, d := range drivers {
+		for _, scheme := range d.Schemes {
+			if scheme != u.Scheme {
+				continue
+			}
+			b, err := d.FromURL(u)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := d.check(b); err != nil {
+				return nil, nil, err
+			}
+			if err := b.Init(); err != nil {
+				return nil, nil, fmt.Errorf("cannot init %s backend at %s: %v", d.Name, u.Host, err)
+			}
+			return b, d, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no driver for %s", raw)
+}
+
+// urlPort returns the port in the url, or the default
+func urlPort(u *url.URL, port int) (int, error) {
+	if p := u.Port(); p != "" {
+		var err error
+		if port, err = strconv.Atoi(p); err != nil {
+			return 0, fmt.Errorf("bad port in %s", u.Host)
+		}
+	}
+	return port, nil
+}
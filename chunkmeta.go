@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/tcolgate/mp3"
+)
+
+// errChunkCorrupt is returned when a chunk doesn't match its checksum
+var errChunkCorrupt = errors.New("chunk checksum mismatch")
+
+// RecorderID identifies this process in the chunks it records
+var RecorderID = recorderID()
+
+func recorderID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// ChunkMeta describes a chunk written to a tape
+type ChunkMeta struct {
+	SHA256     string `json:"sha256"`
+	Length     int    `json:"length"`
+	Codec      string `json:"codec,omitempty"`
+	Bitrate    int    `json:"bitrate,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+	Frames     int    `json:"frames"`
+	Synthetic  bool   `json:"synthetic,omitempty"`
+	Recorder   string `json:"recorder,omitempty"`
+}
+
+// NewChunkMeta checksums a chunk and reads its format
+// from the whole mp3 frames it holds
+func NewChunkMeta(data []byte, synthetic bool) ChunkMeta {
+	sum := sha256.Sum256(data)
+	meta := ChunkMeta{
+		SHA256:    hex.EncodeToString(sum[:]),
+		Length:    len(data),
+		Synthetic: synthetic,
+		Recorder:  RecorderID,
+	}
+
+	d := mp3.NewDecoder(bytes.NewReader(data))
+	var f mp3.Frame
+	skipped := 0
+	for d.Decode(&f, &skipped) == nil {
+		if meta.Frames == 0 {
+			h := f.Header()
+			meta.Codec = "mp3"
+			meta.Bitrate = int(h.BitRate())
+			meta.SampleRate = int(h.SampleRate())
+		}
+		meta.Frames++
+	}
+	return meta
+}
+
+// Verify checks the chunk against its checksum. Chunks
+// recorded without one always pass
+func (m *ChunkMeta) Verify(data []byte) error {
+	if m == nil || m.SHA256 == "" {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != m.SHA256 || len(data) != m.Length {
+		return errChunkCorrupt
+	}
+	return nil
+}
+
+// Fields returns the metadata as string fields, for
+// redis hashes and object metadata
+func (m ChunkMeta) Fields() map[string]string {
+	f := map[string]string{
+		"sha256":    m.SHA256,
+		"length":    strconv.Itoa(m.Length),
+		"frames":    strconv.Itoa(m.Frames),
+		"synthetic": strconv.FormatBool(m.Synthetic),
+	}
+	if m.Codec != "" {
+		f["codec"] = m.Codec
+		f["bitrate"] = strconv.Itoa(m.Bitrate)
+		f["sample_rate"] = strconv.Itoa(m.SampleRate)
+	}
+	if m.Recorder != "" {
+		f["recorder"] = m.Recorder
+	}
+	return f
+}
+
+// ChunkMetaFromFields reads metadata stored by Fields. It
+// returns nil for chunks stored without metadata
+func ChunkMetaFromFields(f map[string]string) (*ChunkMeta, error) {
+	if f["sha256"] == "" {
+		return nil, nil
+	}
+
+	m := &ChunkMeta{
+		SHA256:   f["sha256"],
+		Codec:    f["codec"],
+		Recorder: f["recorder"],
+	}
+	for _, n := range []struct {
+		field string
+		v     *int
+	}{
+		{"length", &m.Length},
+		{"frames", &m.Frames},
+		{"bitrate", &m.Bitrate},
+		{"sample_rate", &m.SampleRate},
+	} {
+		if f[n.field] == "" {
+			continue
+		}
+		v, err := strconv.Atoi(f[n.field])
+		if err != nil {
+			return nil, fmt.Errorf("bad chunk %s %q", n.field, f[n.field])
+		}
+		*n.v = v
+	}
+	m.Synthetic = f["synthetic"] == "true"
+	return m, nil
+}
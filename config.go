@@ -0,0 +1,997 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/api/option"
+)
+
+// A Config holds every setting for the radio. Settings come from
+// defaults, then a TOML config file, then RTM_* environment
+// variables, then command line flags, each overriding the last
+type Config struct {
+	Record        bool
+	Broadcast     bool
+	Addr          string
+	LogLevel      string
+	DSTRepeated   string
+	DSTSkipped    string
+	ReadyChunkAge time.Duration
+
+	Driver      string
+	DBHost      string
+	DBPort      int
+	DBAddrs     []string
+	DBUser      string
+	DBPassword  string
+	DBIndex     int
+	DBTLS       bool
+	DBTLSCAFile string
+	DBPoolSize  int
+
+	RedisSentinelMaster string
+	RedisCluster        bool
+
+	StorageDriver string
+	Bucket        string
+	TapeTimeout   time.Duration
+	TapeRetries   int
+	TierAfter     time.Duration
+	TierInterval  time.Duration
+	Mirrors       []string
+	MirrorQuorum  int
+	MirrorBudget  int
+	Retention     time.Duration
+	Lifecycle     bool
+	SweepInterval time.Duration
+
+	GoogleProject     string
+	GoogleCredentials string
+
+	PresetPoll time.Duration
+
+	BufferChunks int
+
+	CORSOrigins    []string
+	PathBroadcast  string
+	PathPreset     string
+	PathTapes      string
+	TrustedProxies []string
+	GeoIPDB        string
+
+	AdminAddr  string
+	AdminToken string
+
+	AuthRequired   bool
+	AuthAPIKeys    bool
+	AuthSigningKey string
+
+	StreamsPerIP     int
+	StreamsPerKey    int
+	StationListeners int
+	PresetRate       float64
+	PresetBurst      int
+
+	TraceExporter string
+	TraceSample   float64
+}
+
+// DefaultConfig returns the settings used when nothing overrides them
+func DefaultConfig() *Config {
+	return &Config{
+		Record:        true,
+		Broadcast:     true,
+		Addr:          ":8080",
+		LogLevel:      "info",
+		DSTRepeated:   "twice",
+		DSTSkipped:    "fill",
+		Driver:        "redis",
+		DBHost:        "localhost",
+		DBPort:        6379,
+		Bucket:        "radiotimemachine",
+		TapeRetries:   -1,
+		TierInterval:  time.Minute,
+		MirrorQuorum:  1,
+		MirrorBudget:  5,
+		Retention:     TTL,
+		SweepInterval: time.Hour,
+		PresetPoll:    30 * time.Second,
+		PresetBurst:   10,
+		BufferChunks:  BufferChunks,
+		CORSOrigins:   []string{"*"},
+		PathBroadcast: "/listen/",
+		PathPreset:    "/preset/",
+		PathTapes:     "/tapes/",
+		TraceExporter: "none",
+		TraceSample:   1,
+	}
+}
+
+// A setting ties a config field to its file key, env var and flag
+type setting struct {
+	key    string // section.name in the config file
+	flag   string // no flag if empty
+	usage  string
+	secret bool
+	ptr    interface{}
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{key: "record", flag: "record", usage: "Record presets", ptr: &c.Record},
+		{key: "broadcast", flag: "broadcast", usage: "Broadcast to users", ptr: &c.Broadcast},
+		{key: "addr", flag: "addr", usage: "Broadcast address", ptr: &c.Addr},
+		{key: "loglevel", flag: "loglevel", usage: "Logging level: debug|info|warn|error", ptr: &c.LogLevel},
+		{key: "dst.repeated_hour", flag: "dstrepeated", usage: "Play the hour a station repeats when DST ends twice|once", ptr: &c.DSTRepeated},
+		{key: "dst.skipped_hour", flag: "dstskipped", usage: "Skip the hour a station misses when DST starts, or fill it with the hour before: skip|fill", ptr: &c.DSTSkipped},
+
+		{key: "database.driver", flag: "driver", usage: "Database driver: " + strings.Join(DriverNames(CapPresets), "|"), ptr: &c.Driver},
+		{key: "database.host", flag: "dbhost", usage: "Database host", ptr: &c.DBHost},
+		{key: "database.port", flag: "dbport", usage: "Database port", ptr: &c.DBPort},
+		{key: "database.addrs", flag: "dbaddrs", usage: "Comma separated sentinel or cluster nodes, instead of the database host and port", ptr: &c.DBAddrs},
+		{key: "database.user", flag: "dbuser", usage: "Database user", ptr: &c.DBUser},
+		{key: "database.password", usage: "Database password", secret: true, ptr: &c.DBPassword},
+		{key: "database.db", flag: "db", usage: "Database index", ptr: &c.DBIndex},
+		{key: "database.tls", flag: "dbtls", usage: "Connect to the database with TLS", ptr: &c.DBTLS},
+		{key: "database.tls_ca_file", flag: "dbtlscafile", usage: "CA certificates to verify the database with", ptr: &c.DBTLSCAFile},
+		{key: "database.pool_size", flag: "dbpoolsize", usage: "Database connections per server, 0 for the driver default", ptr: &c.DBPoolSize},
+		{key: "database.sentinel_master", flag: "redissentinelmaster", usage: "Redis master name to find through the sentinels", ptr: &c.RedisSentinelMaster},
+		{key: "database.cluster", flag: "rediscluster", usage: "Connect to a redis cluster", ptr: &c.RedisCluster},
+
+		{key: "storage.driver", flag: "storagedriver", usage: "Override storage driver: " + strings.Join(DriverNames(CapTapes), "|"), ptr: &c.StorageDriver},
+		{key: "storage.bucket", flag: "bucketname", usage: "gcs storage bucket", ptr: &c.Bucket},
+		{key: "storage.tape_timeout", flag: "tapetimeout", usage: "Deadline for each tape read or write, overriding the driver default", ptr: &c.TapeTimeout},
+		{key: "storage.tape_retries", flag: "taperetries", usage: "Retries for each failed tape read or write, overriding the driver default", ptr: &c.TapeRetries},
+		{key: "storage.tier_after", flag: "tierafter", usage: "Record to the database and move chunks this old to the storage driver, deleting them from the database, 0 to record straight to storage", ptr: &c.TierAfter},
+		{key: "storage.tier_interval", flag: "tierinterval", usage: "How often chunks are moved to the storage driver", ptr: &c.TierInterval},
+		{key: "storage.mirrors", flag: "mirrors", usage: "Comma separated drivers that each record every chunk, two or more of the database, storage and other configured drivers", ptr: &c.Mirrors},
+		{key: "storage.mirror_quorum", flag: "mirrorquorum", usage: "Mirrors that must write a chunk for it to be recorded", ptr: &c.MirrorQuorum},
+		{key: "storage.mirror_error_budget", flag: "mirrorerrorbudget", usage: "Write failures a minute before a mirror is skipped", ptr: &c.MirrorBudget},
+		{key: "storage.retention", flag: "retention", usage: "How long gcs keeps recorded chunks, which may be longer than the database keeps them", ptr: &c.Retention},
+		{key: "storage.lifecycle", flag: "lifecycle", usage: "Install a gcs lifecycle rule deleting every object in the bucket after the retention, in whole days, unless another age-based rule already deletes them", ptr: &c.Lifecycle},
+		{key: "storage.sweep_interval", flag: "sweepinterval", usage: "How often recorders delete expired gcs chunks, 0 to leave them to a lifecycle rule", ptr: &c.SweepInterval},
+
+		{key: "google.project", flag: "googleproject", usage: "Google cloud project, instead of GOOGLE_CLOUD_PROJECT or DATASTORE_PROJECT_ID", ptr: &c.GoogleProject},
+		{key: "google.credentials_file", flag: "googlecredentials", usage: "Google service account credentials", ptr: &c.GoogleCredentials},
+
+		{key: "presets.poll_interval", flag: "presetpoll", usage: "How often cached presets are reloaded from databases that cannot watch them, 0 to read presets on every lookup", ptr: &c.PresetPoll},
+
+		{key: "stream.buffer_chunks", flag: "bufferchunks", usage: "Chunks sent ahead to fill a listener's buffer", ptr: &c.BufferChunks},
+
+		{key: "http.cors_origins", flag: "corsorigins", usage: "Comma separated origins allowed to make cross origin requests", ptr: &c.CORSOrigins},
+		{key: "http.broadcast_path", flag: "broadcastpath", usage: "Path listeners stream stations from", ptr: &c.PathBroadcast},
+		{key: "http.preset_path", flag: "presetpath", usage: "Path of the preset service", ptr: &c.PathPreset},
+		{key: "http.tapes_path", flag: "tapespath", usage: "Path on the admin server reporting the coverage of recorded tapes", ptr: &c.PathTapes},
+		{key: "http.trusted_proxies", flag: "trustedproxies", usage: "Comma separated networks of proxies trusted to set X-Forwarded-For", ptr: &c.TrustedProxies},
+		{key: "http.geoip_db", flag: "geoipdb", usage: "MaxMind format database used to infer listener zones", ptr: &c.GeoIPDB},
+
+		{key: "admin.addr", flag: "adminaddr", usage: "Address serving preset management, status, metrics and profiling, none if empty", ptr: &c.AdminAddr},
+		{key: "admin.token", usage: "Bearer token admin requests must present", secret: true, ptr: &c.AdminToken},
+
+		{key: "auth.required", flag: "authrequired", usage: "Only stream to listeners with an api key or signed url", ptr: &c.AuthRequired},
+		{key: "auth.api_keys", flag: "apikeys", usage: "Accept listener api keys stored in the database", ptr: &c.AuthAPIKeys},
+		{key: "auth.signing_key", usage: "Secret signing expiring listener urls, none accepted if empty", secret: true, ptr: &c.AuthSigningKey},
+
+		{key: "limits.streams_per_ip", flag: "streamsperip", usage: "Streams each client address may have at once, 0 for no limit", ptr: &c.StreamsPerIP},
+		{key: "limits.streams_per_key", flag: "streamsperkey", usage: "Streams each api key or signed url client may have at once, 0 for no limit", ptr: &c.StreamsPerKey},
+		{key: "limits.station_listeners", flag: "stationlisteners", usage: "Listeners each station may have at once, 0 for no limit", ptr: &c.StationListeners},
+		{key: "limits.preset_rate", flag: "presetrate", usage: "Preset requests a second each client address may make, 0 for no limit", ptr: &c.PresetRate},
+		{key: "limits.preset_burst", flag: "presetburst", usage: "Preset requests a client address may make at once before the rate applies", ptr: &c.PresetBurst},
+
+		{key: "trace.exporter", flag: "traceexporter", usage: "Trace span exporter: none|log|stdout", ptr: &c.TraceExporter},
+		{key: "trace.sample", flag: "tracesample", usage: "Fraction of traces to sample", ptr: &c.TraceSample},
+
+		{key: "health.ready_chunk_age", flag: "readychunkage", usage: "Only report ready if a station recorded a chunk this recently", ptr: &c.ReadyChunkAge},
+	}
+}
+
+// env returns the environment variable overriding the setting
+func (s setting) env() string {
+	return "RTM_" + strings.ToUpper(strings.Replace(s.key, ".", "_", -1))
+}
+
+func (s setting) set(v string) error {
+	var err error
+	switch p := s.ptr.(type) {
+	case *string:
+		*p = v
+	case *int:
+		*p, err = strconv.Atoi(v)
+	case *bool:
+		*p, err = strconv.ParseBool(v)
+	case *float64:
+		*p, err = strconv.ParseFloat(v, 64)
+	case *time.Duration:
+		*p, err = time.ParseDuration(v)
+	case *[]string:
+		*p = nil
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				*p = append(*p, e)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: cannot parse %q", s.key, v)
+	}
+	return nil
+}
+
+// setList sets a list setting from a TOML array
+func (s setting) setList(v []string) error {
+	p, ok := s.ptr.(*[]string)
+	if !ok {
+		return fmt.Errorf("%s: is not a list", s.key)
+	}
+	*p = append([]string(nil), v...)
+	return nil
+}
+
+// toml formats the setting's value as a TOML value
+func (s setting) toml() string {
+	switch p := s.ptr.(type) {
+	case *string:
+		if s.secret && *p != "" {
+			return quoteTOML("********")
+		}
+		return quoteTOML(*p)
+	case *int:
+		return strconv.Itoa(*p)
+	case *bool:
+		return strconv.FormatBool(*p)
+	case *float64:
+		return strconv.FormatFloat(*p, 'g', -1, 64)
+	case *time.Duration:
+		return quoteTOML(p.String())
+	case *[]string:
+		q := make([]string, len(*p))
+		for i, e := range *p {
+			q[i] = quoteTOML(e)
+		}
+		return "[" + strings.Join(q, ", ") + "]"
+	}
+	return ""
+}
+
+// A configFlag records a flag's value to apply after the
+// config file and environment
+type configFlag struct {
+	s   setting
+	def string
+	set map[string]string
+}
+
+func (f *configFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.def
+}
+
+func (f *configFlag) Set(v string) error {
+	f.set[f.s.key] = v
+	return f.s.set(v)
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	_, ok := f.s.ptr.(*bool)
+	return ok
+}
+
+// RegisterFlags adds a flag for each setting that has one, and
+// returns the values given on the command line keyed by setting
+func (c *Config) RegisterFlags(fs *flag.FlagSet) map[string]string {
+	set := make(map[string]string)
+	for _, s := range c.settings() {
+		if s.flag == "" {
+			continue
+		}
+		def := strings.Trim(s.toml(), `"[]`)
+		fs.Var(&configFlag{s: s, def: def, set: set}, s.flag, s.usage)
+	}
+	return set
+}
+
+// Load applies the config file, if any, then the environment,
+// then the flags, and validates the result
+func (c *Config) Load(path string, lookupEnv func(string) (string, bool), flags map[string]string) error {
+	var errs ConfigErrors
+	settings := c.settings()
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return ConfigErrors{err}
+		}
+		values, err := parseTOML(f)
+		f.Close()
+		if err != nil {
+			return ConfigErrors{fmt.Errorf("%s: %v", path, err)}
+		}
+
+		known := make(map[string]setting)
+		for _, s := range settings {
+			known[s.key] = s
+		}
+		for _, k := range sortedKeys(values) {
+			s, ok := known[k]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown setting %s", path, k))
+				continue
+			}
+			var err error
+			if list, ok := values[k].([]string); ok {
+				err = s.setList(list)
+			} else {
+				err = s.set(values[k].(string))
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", path, err))
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := lookupEnv(s.env()); ok {
+			if err := s.set(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", s.env(), err))
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := flags[s.key]; ok {
+			if err := s.set(v); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %v", s.flag, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	if errs = c.Validate(); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Validate checks that the settings make sense together
+func (c *Config) Validate() ConfigErrors {
+	var errs ConfigErrors
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		fail("loglevel: no %q loglevel found", c.LogLevel)
+	}
+	if _, err := ParseDSTPolicy(c.DSTRepeated, c.DSTSkipped); err != nil {
+		fail("dst: %v", err)
+	}
+
+	if c.DBPort < 1 || c.DBPort > 65535 {
+		fail("database.port: %d is not a port", c.DBPort)
+	}
+	if c.DBIndex < 0 {
+		fail("database.db: %d is not a database index", c.DBIndex)
+	}
+	if c.DBTLSCAFile != "" && !c.DBTLS {
+		fail("database.tls_ca_file: set without database.tls")
+	}
+	if c.DBPoolSize < 0 {
+		fail("database.pool_size: %d is negative", c.DBPoolSize)
+	}
+	errs = append(errs, c.validateDrivers()...)
+
+	if c.TapeTimeout < 0 {
+		fail("storage.tape_timeout: %s is negative", c.TapeTimeout)
+	}
+	if c.TapeRetries < -1 {
+		fail("storage.tape_retries: %d is negative", c.TapeRetries)
+	}
+	if c.TierAfter < 0 {
+		fail("storage.tier_after: %s is negative", c.TierAfter)
+	}
+	if c.TierAfter > 0 {
+		if c.StorageDriver == "" {
+			fail("storage.tier_after: needs a storage driver to move chunks to")
+		}
+		// the database expires chunks the mover hasn't reached
+		if c.TierInterval <= 0 {
+			fail("storage.tier_interval: %s is not positive", c.TierInterval)
+		} else if c.TierAfter+c.TierInterval >= TTL {
+			fail("storage.tier_after: chunks moved every %s after %s expire from the database after %s first", c.TierInterval, c.TierAfter, TTL)
+		}
+		if c.Retention <= c.TierAfter {
+			fail("storage.retention: %s deletes chunks before they are moved after %s", c.Retention, c.TierAfter)
+		}
+	}
+	if c.Retention < time.Second*ChunkSeconds {
+		fail("storage.retention: %s is shorter than a chunk", c.Retention)
+	}
+	if c.SweepInterval < 0 {
+		fail("storage.sweep_interval: %s is negative", c.SweepInterval)
+	}
+	if len(c.Mirrors) > 0 {
+		listed := map[string]bool{}
+		for _, name := range c.Mirrors {
+			if listed[name] {
+				fail("storage.mirrors: %s is listed twice", name)
+			}
+			listed[name] = true
+		}
+		if len(c.Mirrors) < 2 {
+			fail("storage.mirrors: needs two or more drivers to mirror")
+		}
+		if c.StorageDriver != "" && !listed[c.StorageDriver] {
+			fail("storage.mirrors: must include the storage driver %s", c.StorageDriver)
+		}
+		if c.TierAfter > 0 {
+			fail("storage.mirrors: cannot be used with storage.tier_after")
+		}
+		if c.MirrorQuorum < 1 || c.MirrorQuorum > len(c.Mirrors) {
+			fail("storage.mirror_quorum: %d is not between 1 and the %d mirrors", c.MirrorQuorum, len(c.Mirrors))
+		}
+		if c.MirrorBudget < 1 {
+			fail("storage.mirror_error_budget: %d is not positive", c.MirrorBudget)
+		}
+	}
+
+	if c.PresetPoll < 0 {
+		fail("presets.poll_interval: %s is negative", c.PresetPoll)
+	}
+
+	if c.BufferChunks < 1 {
+		fail("stream.buffer_chunks: at least one chunk must be buffered")
+	}
+
+	paths := make(map[string]string)
+	for _, p := range []struct{ key, path string }{
+		{"http.broadcast_path", c.PathBroadcast},
+		{"http.preset_path", c.PathPreset},
+		{"http.tapes_path", c.PathTapes},
+	} {
+		if !strings.HasPrefix(p.path, "/") || !strings.HasSuffix(p.path, "/") {
+			fail("%s: %q must begin and end with /", p.key, p.path)
+		}
+		if other, ok := paths[p.path]; ok {
+			fail("%s: %q is also %s", p.key, p.path, other)
+		}
+		paths[p.path] = p.key
+	}
+	if _, err := ParseCIDRs(strings.Join(c.TrustedProxies, ",")); err != nil {
+		fail("http.trusted_proxies: %v", err)
+	}
+
+	if c.AdminAddr != "" {
+		if c.AdminToken == "" {
+			fail("admin.token: required to serve admin requests")
+		}
+		if c.AdminAddr == c.Addr {
+			fail("admin.addr: %q is also the broadcast address", c.AdminAddr)
+		}
+	}
+
+	if c.AuthRequired && !c.AuthAPIKeys && c.AuthSigningKey == "" {
+		fail("auth.required: needs auth.api_keys or auth.signing_key to let anyone listen")
+	}
+	if s := c.AuthSigningKey; s != "" && len(s) < MinSigningKey {
+		fail("auth.signing_key: shorter than %d bytes", MinSigningKey)
+	}
+
+	for _, l := range []struct {
+		key   string
+		limit int
+	}{
+		{"limits.streams_per_ip", c.StreamsPerIP},
+		{"limits.streams_per_key", c.StreamsPerKey},
+		{"limits.station_listeners", c.StationListeners},
+	} {
+		if l.limit < 0 {
+			fail("%s: %d is negative", l.key, l.limit)
+		}
+	}
+	if c.PresetRate < 0 {
+		fail("limits.preset_rate: %g is negative", c.PresetRate)
+	}
+	if c.PresetRate > 0 && c.PresetBurst < 1 {
+		fail("limits.preset_burst: at least one request must be allowed")
+	}
+
+	switch c.TraceExporter {
+	case "", "none", "log", "stdout":
+	default:
+		fail("trace.exporter: no %q trace exporter found", c.TraceExporter)
+	}
+	if c.TraceSample < 0 || c.TraceSample > 1 {
+		fail("trace.sample: %g is not a fraction", c.TraceSample)
+	}
+
+	if c.ReadyChunkAge < 0 {
+		fail("health.ready_chunk_age: %s is negative", c.ReadyChunkAge)
+	}
+
+	return errs
+}
+
+// validateDrivers checks that the drivers exist, that together they
+// hold presets and record tapes, and that their settings make sense
+func (c *Config) validateDrivers() (errs ConfigErrors) {
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	db, ok := LookupDriver(c.Driver)
+	if !ok {
+		fail("database.driver: no %q driver found, use one of %s",
+			c.Driver, strings.Join(DriverNames(0), "|"))
+		return errs
+	}
+	if !db.Has(CapPresets) {
+		fail("database.driver: %s cannot hold presets, use one of %s",
+			c.Driver, strings.Join(DriverNames(CapPresets), "|"))
+	}
+	if c.AuthAPIKeys && !db.Has(CapKeys) {
+		fail("auth.api_keys: %s cannot hold api keys, use one of %s",
+			c.Driver, strings.Join(DriverNames(CapKeys), "|"))
+	}
+	used := []*Driver{db}
+
+	// the database records tapes unless there is a storage driver,
+	// and also does when tiering. mirrors record tapes on their own
+	tapes := []*Driver{db}
+	if c.StorageDriver != "" {
+		storage, ok := LookupDriver(c.StorageDriver)
+		if !ok {
+			fail("storage.driver: no %q driver found, use one of %s",
+				c.StorageDriver, strings.Join(DriverNames(CapTapes), "|"))
+			return errs
+		}
+		used = append(used, storage)
+		tapes = []*Driver{storage}
+		if c.TierAfter > 0 {
+			tapes = append(tapes, db)
+		}
+	}
+	if len(c.Mirrors) > 0 {
+		tapes = nil
+		for _, name := range c.Mirrors {
+			d, ok := LookupDriver(name)
+			if !ok {
+				fail("storage.mirrors: no %q driver found, use one of %s",
+					name, strings.Join(DriverNames(CapTapes), "|"))
+				continue
+			}
+			tapes = append(tapes, d)
+			if !hasDriver(used, d) {
+				used = append(used, d)
+			}
+		}
+	}
+	for _, d := range tapes {
+		switch {
+		case !d.Has(CapTapes) && len(c.Mirrors) > 0:
+			fail("storage.mirrors: %s cannot record tapes, use one of %s",
+				d.Name, strings.Join(DriverNames(CapTapes), "|"))
+		case !d.Has(CapTapes) && d == db && c.StorageDriver == "":
+			fail("storage.driver: required, since the %s database cannot record tapes, use one of %s",
+				d.Name, strings.Join(DriverNames(CapTapes), "|"))
+		case !d.Has(CapTapes) && d == db:
+			fail("database.driver: %s cannot record tapes for tiering", d.Name)
+		case !d.Has(CapTapes):
+			fail("storage.driver: %s cannot record tapes, use one of %s",
+				d.Name, strings.Join(DriverNames(CapTapes), "|"))
+		case !d.Has(CapTTL) && c.SweepInterval == 0 && !c.Lifecycle:
+			fail("storage.sweep_interval: the %s driver doesn't expire chunks, so they must be swept", d.Name)
+		}
+	}
+
+	validated := map[*Driver]bool{}
+	for _, d := range used {
+		if d.Validate != nil && !validated[d] {
+			errs = append(errs, d.Validate(c)...)
+			validated[d] = true
+		}
+	}
+
+	// settings only some drivers read must be left alone for the others
+	owners := map[string][]string{}
+	for _, d := range drivers {
+		for _, key := range d.Settings {
+			owners[key] = append(owners[key], d.Name)
+		}
+	}
+	reads := map[string]bool{}
+	for _, d := range used {
+		for _, key := range d.Settings {
+			reads[key] = true
+		}
+	}
+	defaults := DefaultConfig().settings()
+	for i, s := range c.settings() {
+		if _, owned := owners[s.key]; !owned || reads[s.key] {
+			continue
+		}
+		if s.toml() != defaults[i].toml() {
+			sort.Strings(owners[s.key])
+			fail("%s: only read by %s, not %s", s.key,
+				strings.Join(owners[s.key], " or "), driverList(used))
+		}
+	}
+	return errs
+}
+
+// hasDriver reports whether the driver is among those in use
+func hasDriver(used []*Driver, d *Driver) bool {
+	for _, u := range used {
+		if u == d {
+			return true
+		}
+	}
+	return false
+}
+
+// driverList names the drivers in use
+func driverList(used []*Driver) string {
+	names := make([]string, len(used))
+	for i, d := range used {
+		names[i] = d.Name
+	}
+	return strings.Join(names, " or ")
+}
+
+// OpPolicy returns the policy for tape operations on a driver,
+// with the configured timeout and retries
+func (c *Config) OpPolicy(driver string) OpPolicy {
+	p := DefaultOpPolicies[driver]
+	if c.TapeTimeout > 0 {
+		p.Timeout = c.TapeTimeout
+	}
+	if c.TapeRetries >= 0 {
+		p.Retries = c.TapeRetries
+	}
+	return p
+}
+
+// GoogleOptions returns the client options for google cloud drivers
+func (c *Config) GoogleOptions() []option.ClientOption {
+	if c.GoogleCredentials == "" {
+		return nil
+	}
+	return []option.ClientOption{option.WithCredentialsFile(c.GoogleCredentials)}
+}
+
+// DBTLSConfig returns the TLS config for the database, or nil. The
+// server name is left for the client to take from each address
+// when connecting to sentinel or cluster nodes
+func (c *Config) DBTLSConfig() (*tls.Config, error) {
+	if !c.DBTLS {
+		return nil, nil
+	}
+	cfg := &tls.Config{}
+	if len(c.DBAddrs) == 0 {
+		cfg.ServerName = c.DBHost
+	}
+	if c.DBTLSCAFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := ioutil.ReadFile(c.DBTLSCAFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RootCAs = x509.NewCertPool()
+	if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", c.DBTLSCAFile)
+	}
+	return cfg, nil
+}
+
+// WriteTOML writes the config as a TOML file, masking secrets
+func (c *Config) WriteTOML(w io.Writer) error {
+	section := ""
+	for _, s := range c.settings() {
+		sec, name := "", s.key
+		if i := strings.LastIndex(s.key, "."); i >= 0 {
+			sec, name = s.key[:i], s.key[i+1:]
+		}
+		if sec != section {
+			if _, err := fmt.Fprintf(w, "\n[%s]\n", sec); err != nil {
+				return err
+			}
+			section = sec
+		}
+		if _, err := fmt.Fprintf(w, "%s = %s\n", name, s.toml()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfigErrors are all the problems found in a config
+type ConfigErrors []error
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// parseTOML reads the subset of TOML used by config files: tables,
+// and keys holding basic or literal strings, numbers, booleans or
+// arrays of them, which may span lines. Multi-line strings, dates,
+// inline tables and arrays of tables are not supported. Values are
+// keyed by table.key, scalars as strings and arrays as []string
+func parseTOML(r io.Reader) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	table := ""
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated table", n)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			if table == "" {
+				return nil, fmt.Errorf("line %d: empty table name", n)
+			}
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 1 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if table != "" {
+			key = table + "." + key
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("line %d: %s is set twice", n, key)
+		}
+
+		// arrays continue on the following lines until closed
+		start, v := n, strings.TrimSpace(line[eq+1:])
+		for strings.HasPrefix(v, "[") && arrayEnd(v) < 0 && scanner.Scan() {
+			n++
+			v += " " + strings.TrimSpace(stripComment(scanner.Text()))
+		}
+
+		value, err := parseTOMLValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", start, err)
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// parseTOMLValue parses a scalar as a string and an array as []string
+func parseTOMLValue(v string) (interface{}, error) {
+	if !strings.HasPrefix(v, "[") {
+		return parseTOMLScalar(v)
+	}
+
+	end := arrayEnd(v)
+	switch {
+	case end < 0:
+		return nil, errors.New("unterminated array")
+	case end != len(v)-1:
+		return nil, errors.New("unexpected text after array")
+	}
+	elems := []string{}
+	parts := splitTOMLArray(v[1:end])
+	for i, e := range parts {
+		// a trailing comma is allowed
+		if e = strings.TrimSpace(e); e == "" && i == len(parts)-1 {
+			break
+		}
+		if strings.HasPrefix(e, "[") {
+			return nil, errors.New("nested arrays are not supported")
+		}
+		s, err := parseTOMLScalar(e)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, s)
+	}
+	return elems, nil
+}
+
+func parseTOMLScalar(v string) (string, error) {
+	switch {
+	case v == "":
+		return "", errors.New("missing value")
+	case strings.HasPrefix(v, `"`):
+		return unquoteTOML(v)
+	case strings.HasPrefix(v, "'"):
+		if len(v) < 2 || !strings.HasSuffix(v, "'") || strings.Count(v, "'") != 2 {
+			return "", errors.New("unterminated string")
+		}
+		return v[1 : len(v)-1], nil
+	}
+	return v, nil
+}
+
+// unquoteTOML unquotes a basic string, which unlike a Go string
+// only has the escapes \b \t \n \f \r \" \\ \uXXXX and \UXXXXXXXX
+func unquoteTOML(v string) (string, error) {
+	if len(v) < 2 || !strings.HasSuffix(v, `"`) {
+		return "", errors.New("unterminated string")
+	}
+	v = v[1 : len(v)-1]
+
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c == '"':
+			return "", errors.New("unescaped quote in string")
+		case c != '\\':
+			b.WriteByte(c)
+			continue
+		}
+
+		if i++; i == len(v) {
+			return "", errors.New("unterminated string")
+		}
+		switch e := v[i]; e {
+		case 'b':
+			b.WriteByte('\b')
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'f':
+			b.WriteByte('\f')
+		case 'r':
+			b.WriteByte('\r')
+		case '"', '\\':
+			b.WriteByte(e)
+		case 'u', 'U':
+			n := 4
+			if e == 'U' {
+				n = 8
+			}
+			if i+n >= len(v) {
+				return "", fmt.Errorf("short \\%c escape", e)
+			}
+			r, err := strconv.ParseUint(v[i+1:i+1+n], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(r)) {
+				return "", fmt.Errorf("invalid \\%c escape", e)
+			}
+			b.WriteRune(rune(r))
+			i += n
+		default:
+			return "", fmt.Errorf("invalid escape \\%c", e)
+		}
+	}
+	return b.String(), nil
+}
+
+// quoteTOML quotes a basic string with TOML's escapes
+func quoteTOML(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// arrayEnd returns the index of the bracket closing the array
+// starting s, or -1 if it isn't closed
+func arrayEnd(s string) int {
+	var quote byte
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitTOMLArray splits array elements on commas outside strings
+func splitTOMLArray(s string) []string {
+	var elems []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			elems = append(elems, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(elems, s[start:])
+}
+
+// stripComment removes a # comment outside strings
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTOML(t *testing.T) {
+	values, err := parseTOML(strings.NewReader(`
+# top level settings
+loglevel = "debug" # inline comment
+record = false
+
+[database]
+driver = 'etcd'
+port = 2379
+password = "p#ss\"word\u00e9\t"
+user = 'C:\db\user'
+
+[http]
+cors_origins = ["https://a.example", 'https://b.example', ]
+trusted_proxies = [
+	"10.0.0.0/8", # the load balancers
+	"a,b",
+	"x]",
+]
+empty = []
+`))
+	if err != nil {
+		t.Fatalf("parseTOML failed: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"loglevel":             "debug",
+		"record":               "false",
+		"database.driver":      "etcd",
+		"database.port":        "2379",
+		"database.password":    "p#ss\"word\u00e9\t",
+		"database.user":        `C:\db\user`,
+		"http.cors_origins":    []string{"https://a.example", "https://b.example"},
+		"http.trusted_proxies": []string{"10.0.0.0/8", "a,b", "x]"},
+		"http.empty":           []string{},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("values wrong. expected %v, got %v", expected, values)
+	}
+
+	for _, bad := range []string{
+		"[database",
+		"novalue",
+		"key = ",
+		`key = "unterminated`,
+		"key = [\"a\"",
+		"key = [\n\"a\",\n",
+		"key = [\"a\",,\"b\"]",
+		"key = [[\"a\"]]",
+		"key = [\"a\"] b",
+		`key = "\x41"`,
+		`key = "\a"`,
+		`key = "\u12"`,
+		`key = "a"b"`,
+		"key = 'a'b'",
+		"a = 1\na = 2",
+	} {
+		if _, err := parseTOML(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseTOML accepted %q", bad)
+		}
+	}
+}
+
+func TestConfigLoad(t *testing.T) {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatalf("unable to create config file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+addr = ":9000"
+loglevel = "warn"
+
+[database]
+driver = "ssdb"
+host = "db.example"
+port = 8888
+
+[stream]
+buffer_chunks = 4
+`)
+	f.Close()
+
+	// defaults < file < env < flags
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flagged := cfg.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-dbport", "9999", "-record=false"}); err != nil {
+		t.Fatalf("flags failed: %v", err)
+	}
+	env := map[string]string{
+		"RTM_DATABASE_PORT":     "7777",
+		"RTM_DATABASE_HOST":     "env.example",
+		"RTM_DATABASE_PASSWORD": "secret",
+		"RTM_HTTP_CORS_ORIGINS": "https://a.example, https://b.example",
+	}
+	lookupEnv := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+	if err := cfg.Load(f.Name(), lookupEnv, flagged); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	expected := DefaultConfig()
+	expected.Addr = ":9000"
+	expected.LogLevel = "warn"
+	expected.Driver = "ssdb"
+	expected.DBHost = "env.example"
+	expected.DBPort = 9999
+	expected.DBPassword = "secret"
+	expected.BufferChunks = 4
+	expected.Record = false
+	expected.CORSOrigins = []string{"https://a.example", "https://b.example"}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("config wrong.\nexpected %+v\ngot      %+v", expected, cfg)
+	}
+
+	// secrets are masked, and the rest survives a round trip
+	var buf bytes.Buffer
+	cfg.WriteTOML(&buf)
+	if strings.Contains(buf.String(), "secret") {
+		t.Errorf("password not masked:\n%s", buf.String())
+	}
+	round := DefaultConfig()
+	written := strings.Replace(buf.String(), `"********"`, `""`, 1)
+	f, _ = ioutil.TempFile("", "config")
+	defer os.Remove(f.Name())
+	f.WriteString(written)
+	f.Close()
+	noEnv := func(string) (string, bool) { return "", false }
+	if err := round.Load(f.Name(), noEnv, nil); err != nil {
+		t.Fatalf("unable to load written config: %v", err)
+	}
+	round.DBPassword = cfg.DBPassword
+	if !reflect.DeepEqual(round, cfg) {
+		t.Errorf("config changed in round trip.\nexpected %+v\ngot      %+v", cfg, round)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if errs := DefaultConfig().Validate(); len(errs) > 0 {
+		t.Errorf("default config invalid: %v", errs)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Driver = "mongodb"
+	cfg.DBPort = 0
+	cfg.PathPreset = "preset"
+	cfg.TraceSample = 2
+	cfg.TapeTimeout = -time.Second
+	cfg.TierAfter = time.Hour
+	cfg.AdminAddr = ":8081"
+	cfg.AuthRequired = true
+	cfg.StreamsPerIP = -1
+	if errs := cfg.Validate(); len(errs) != 9 {
+		t.Errorf("expected 9 errors, got %d: %v", len(errs), errs)
+	}
+
+	for _, c := range []struct {
+		driver, storage string
+		set             func(c *Config)
+		err             string
+	}{
+		{"firestore", "", nil, "storage.driver: required"},
+		{"firestore", "gcs", nil, ""},
+		{"firestore", "gcs", func(c *Config) { c.TierAfter = time.Hour }, "cannot record tapes for tiering"},
+		{"redis", "gcs", func(c *Config) { c.TierAfter = 23 * time.Hour; c.Retention = 48 * time.Hour }, ""},
+		{"redis", "gcs", func(c *Config) { c.TierAfter = TTL; c.Retention = 2 * TTL }, "expire from the database"},
+		{"redis", "gcs", func(c *Config) { c.TierAfter = 2 * time.Hour; c.Retention = time.Hour }, "storage.retention"},
+		{"redis", "firestore", nil, "storage.driver: firestore cannot record"},
+		{"redis", "gcs", func(c *Config) { c.Mirrors = []string{"redis", "gcs", "datastore"}; c.MirrorQuorum = 2 }, ""},
+		{"redis", "", func(c *Config) { c.Mirrors = []string{"redis"} }, "two or more"},
+		{"redis", "gcs", func(c *Config) { c.Mirrors = []string{"redis", "datastore"} }, "must include the storage driver gcs"},
+		{"redis", "", func(c *Config) { c.Mirrors = []string{"redis", "firestore"} }, "storage.mirrors: firestore cannot record"},
+		{"redis", "", func(c *Config) { c.Mirrors = []string{"redis", "etcd"}; c.MirrorQuorum = 3 }, "storage.mirror_quorum"},
+		{"redis", "gcs", func(c *Config) { c.Bucket = "" }, "storage.bucket"},
+		{"etcd", "", func(c *Config) { c.RedisSentinelMaster = "mymaster" }, "only read by redis, not etcd"},
+		{"datastore", "", func(c *Config) { c.SweepInterval = 0 }, "storage.sweep_interval"},
+	} {
+		cfg := DefaultConfig()
+		cfg.Driver, cfg.StorageDriver = c.driver, c.storage
+		if c.storage == "gcs" {
+			cfg.Bucket = "tapes"
+		}
+		if c.set != nil {
+			c.set(cfg)
+		}
+		errs := cfg.Validate()
+		if c.err == "" && len(errs) > 0 {
+			t.Errorf("%s+%s: unexpected errors %v", c.driver, c.storage, errs)
+		}
+		if c.err != "" && (len(errs) != 1 || !strings.Contains(errs[0].Error(), c.err)) {
+			t.Errorf("%s+%s: expected an error about %q, got %v", c.driver, c.storage, c.err, errs)
+		}
+	}
+
+	if err := DefaultConfig().Load("/nonexistent/config.toml", os.LookupEnv, nil); err == nil {
+		t.Errorf("Load accepted a missing config file")
+	}
+
+	cfg = DefaultConfig()
+	lookupEnv := func(k string) (string, bool) {
+		return map[string]string{"RTM_DATABASE_PORT": "lots"}[k], k == "RTM_DATABASE_PORT"
+	}
+	if err := cfg.Load("", lookupEnv, nil); err == nil || !strings.Contains(err.Error(), "RTM_DATABASE_PORT") {
+		t.Errorf("expected an error naming RTM_DATABASE_PORT, got %v", err)
+	}
+}
+
+func TestDBTLSConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	if tc, err := cfg.DBTLSConfig(); err != nil || tc != nil {
+		t.Errorf("expected no TLS config, got %v %v", tc, err)
+	}
+
+	cfg.DBTLS = true
+	cfg.DBHost = "db.example"
+	if tc, err := cfg.DBTLSConfig(); err != nil || tc.ServerName != "db.example" {
+		t.Errorf("expected the database host as server name, got %v %v", tc, err)
+	}
+
+	// each node is verified against its own name
+	cfg.DBAddrs = []string{"node1.example:6379", "node2.example:6379"}
+	if tc, err := cfg.DBTLSConfig(); err != nil || tc.ServerName != "" {
+		t.Errorf("expected no server name for nodes, got %v %v", tc, err)
+	}
+}
@@ -2,19 +2,48 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
-// DatastoreBackend implements PresetBackend
+func init() {
+	RegisterDriver(&Driver{
+		Name:         "datastore",
+		Capabilities: CapPresets | CapTapes | CapListing | CapKeys,
+		Settings:     []string{"google.project", "google.credentials_file"},
+		Schemes:      []string{"datastore"},
+		Open: func(c *Config) (Backend, error) {
+			return &DatastoreBackend{
+				project: c.GoogleProject,
+				opts:    c.GoogleOptions(),
+				policy:  c.OpPolicy("datastore"),
+			}, nil
+		},
+		FromURL: func(u *url.URL) (Backend, error) {
+			return &DatastoreBackend{project: u.Host, policy: DefaultOpPolicies["datastore"]}, nil
+		},
+	})
+}
+
+// DatastoreBackend implements PresetBackend and TapeBackend
 type DatastoreBackend struct {
-	client *datastore.Client
+	project string // falls back to DATASTORE_PROJECT_ID
+	opts    []option.ClientOption
+	policy  OpPolicy
+	client  *datastore.Client
 }
 
 // Implements Backend
 func (b *DatastoreBackend) Init() error {
 	ctx := context.Background()
-	client, err := datastore.NewClient(ctx, "") // inject via DATASTORE_PROJECT_ID
+	client, err := datastore.NewClient(ctx, b.project, b.opts...)
 	if err != nil {
 		return err
 	}
@@ -22,6 +51,13 @@ func (b *DatastoreBackend) Init() error {
 	return nil
 }
 
+// Implements Pinger
+func (b *DatastoreBackend) Ping(ctx context.Context) error {
+	q := datastore.NewQuery("Preset").KeysOnly().Limit(1)
+	_, err := b.client.GetAll(ctx, q, nil)
+	return err
+}
+
 type PresetEntity struct {
 	Value []byte
 }
@@ -30,8 +66,7 @@ type PresetEntity struct {
 func (b DatastoreBackend) ReadPreset(name string) (data []byte, err error) {
 	k := datastore.NameKey("Preset", name, nil)
 	p := new(PresetEntity)
-	b.client.Get(context.Background(), k, p)
-	if err != nil {
+	if err = b.client.Get(context.Background(), k, p); err != nil {
 		return
 	}
 	data = make([]byte, len(p.Value))
@@ -52,6 +87,41 @@ func (b DatastoreBackend) ReadAllPresets() (data [][]byte, err error) {
 	return
 }
 
+// ListPresets pages through the presets with datastore cursors
+func (b DatastoreBackend) ListPresets(cursor string, limit int) (data [][]byte, next string, err error) {
+	ctx := context.Background()
+	q := datastore.NewQuery("Preset").Limit(limit)
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(c)
+	}
+
+	it := b.client.Run(ctx, q)
+	for {
+		var p PresetEntity
+		_, err := it.Next(&p)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		data = append(data, p.Value)
+	}
+
+	if len(data) == limit {
+		c, err := it.Cursor()
+		if err != nil {
+			return nil, "", err
+		}
+		next = c.String()
+	}
+	return data, next, nil
+}
+
 func (b DatastoreBackend) WritePreset(name string, data []byte) error {
 	k := datastore.NameKey("Preset", name, nil)
 	if _, err := b.client.Put(context.Background(), k, &PresetEntity{Value: data}); err != nil {
@@ -59,3 +129,172 @@ func (b DatastoreBackend) WritePreset(name string, data []byte) error {
 	}
 	return nil
 }
+
+// An APIKeyEntity is an api key stored under the hash of its secret
+type APIKeyEntity struct {
+	Value []byte `datastore:",noindex"`
+}
+
+// Implements KeyBackend
+func (b DatastoreBackend) ReadKey(hash string) (data []byte, err error) {
+	k := datastore.NameKey("APIKey", hash, nil)
+	e := new(APIKeyEntity)
+	err = b.client.Get(context.Background(), k, e)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e.Value, nil
+}
+
+func (b DatastoreBackend) WriteKey(hash string, data []byte) error {
+	k := datastore.NameKey("APIKey", hash, nil)
+	_, err := b.client.Put(context.Background(), k, &APIKeyEntity{Value: data})
+	return err
+}
+
+// A ChunkEntity is a chunk stored under a key named for its station
+// and time, so a station's chunks are listed by key range. Entities
+// past their expiry are never played, and are deleted by the Sweep
+type ChunkEntity struct {
+	Data    []byte `datastore:",noindex"`
+	Meta    []byte `datastore:",noindex"`
+	Expires time.Time
+}
+
+// chunkKey returns the key of a station's chunk
+func chunkKey(name, key string) *datastore.Key {
+	return datastore.NameKey("Chunk", fmt.Sprintf("%s/%s", name, key), nil)
+}
+
+// Implements RecordedTape
+func (b *DatastoreBackend) RecordedTape(ctx context.Context, name string, i Incrementer) (*RecordedTape, error) {
+	return &RecordedTape{
+		tape: &DatastoreTape{
+			name:   name,
+			i:      i,
+			policy: b.policy,
+			client: b.client,
+		},
+	}, nil
+}
+
+// Implements BlankTape
+func (b *DatastoreBackend) BlankTape(ctx context.Context, name string, i Incrementer) (*BlankTape, error) {
+	return &BlankTape{
+		tape: &DatastoreTape{
+			name:   name,
+			i:      i,
+			policy: b.policy,
+			client: b.client,
+		},
+	}, nil
+}
+
+// Implements TapeBackend
+func (b *DatastoreBackend) ListChunks(ctx context.Context, name string, from, to time.Time) ([]time.Time, error) {
+	q := datastore.NewQuery("Chunk").KeysOnly().
+		Filter("__key__ >=", chunkKey(name, from.UTC().Format(time.RFC3339))).
+		Filter("__key__ <", chunkKey(name, to.UTC().Format(time.RFC3339)))
+	keys, err := b.client.GetAll(ctx, q, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []time.Time
+	for _, k := range keys {
+		if t, ok := chunkTime(strings.TrimPrefix(k.Name, name+"/")); ok {
+			chunks = append(chunks, t)
+		}
+	}
+	return chunks, nil
+}
+
+// Implements Sweeper, deleting chunk entities past their expiry
+func (b *DatastoreBackend) Sweep(ctx context.Context, now time.Time) (int, error) {
+	q := datastore.NewQuery("Chunk").KeysOnly().Filter("Expires <", now)
+	keys, err := b.client.GetAll(ctx, q, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// datastore deletes at most 500 entities at once
+	n := 0
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > 500 {
+			batch = batch[:500]
+		}
+		if err := b.client.DeleteMulti(ctx, batch); err != nil {
+			return n, err
+		}
+		for _, k := range batch {
+			metricChunksSwept.Add(1, strings.SplitN(k.Name, "/", 2)[0])
+		}
+		n += len(batch)
+		keys = keys[len(batch):]
+	}
+	return n, nil
+}
+
+// Implements ChunkDeleter, the metadata is on the chunk's entity
+func (b *DatastoreBackend) DeleteChunk(ctx context.Context, name string, cue time.Time) error {
+	return b.client.Delete(ctx, chunkKey(name, cue.UTC().Format(time.RFC3339)))
+}
+
+// A DatastoreTape implements BlankTape and RecordedTape
+// and stores entries with an expiry according to TTL
+type DatastoreTape struct {
+	name   string
+	i      Incrementer
+	policy OpPolicy
+	client *datastore.Client
+}
+
+func (t *DatastoreTape) Write(ctx context.Context, data []byte, meta ChunkMeta) error {
+	k := chunkKey(t.name, t.i.Key())
+	m, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	e := &ChunkEntity{Data: data, Meta: m, Expires: time.Now().Add(TTL)}
+
+	return t.policy.Do(ctx, func(ctx context.Context) error {
+		_, err := t.client.Put(ctx, k, e)
+		return err
+	})
+}
+
+func (t *DatastoreTape) Read(ctx context.Context) ([]byte, *ChunkMeta, error) {
+	k := chunkKey(t.name, t.i.Key())
+
+	var e *ChunkEntity
+	err := t.policy.Do(ctx, func(ctx context.Context) error {
+		got := &ChunkEntity{}
+		err := t.client.Get(ctx, k, got)
+		if err == datastore.ErrNoSuchEntity {
+			return Permanent(err)
+		}
+		if err != nil {
+			return err
+		}
+		if got.Expires.Before(time.Now()) {
+			return Permanent(datastore.ErrNoSuchEntity)
+		}
+		return keep(ctx, func() { e = got })
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var meta *ChunkMeta
+	if len(e.Meta) > 0 {
+		meta = &ChunkMeta{}
+		if err := json.Unmarshal(e.Meta, meta); err != nil {
+			return nil, nil, err
+		}
+	}
+	return e.Data, meta, nil
+}
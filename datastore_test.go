@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDatastoreTapes(t *testing.T) {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST is not set")
+	}
+
+	b := &DatastoreBackend{project: "rtm", policy: DefaultOpPolicies["datastore"]}
+	if err := b.Init(); err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+	ctx := context.Background()
+	cue := time.Now().Truncate(time.Second * ChunkSeconds)
+
+	blank, _ := b.BlankTape(ctx, "datastore", Incrementer{cue})
+	for i := 0; i < 3; i++ {
+		if _, err := blank.Write(data); err != nil {
+			t.Fatalf("BlankTape Write() failed: %v", err)
+		}
+	}
+
+	tape, _ := b.RecordedTape(ctx, "datastore", Incrementer{cue})
+	if d, err := tape.Read(); err != nil || !bytes.Equal(d, data) {
+		t.Errorf("RecordedTape Read() = %q, %v", d, err)
+	}
+
+	chunks, err := b.ListChunks(ctx, "datastore", cue.Add(20*time.Second), cue.Add(time.Hour))
+	if err != nil || len(chunks) != 2 || !chunks[0].Equal(cue.Add(20*time.Second)) {
+		t.Errorf("ListChunks() = %v, %v", chunks, err)
+	}
+
+	if n, err := b.Sweep(ctx, time.Now().Add(TTL+time.Minute)); err != nil || n < 3 {
+		t.Errorf("Sweep() = %d, %v", n, err)
+	}
+	tape, _ = b.RecordedTape(ctx, "datastore", Incrementer{cue})
+	if _, err := tape.Read(); err == nil {
+		t.Errorf("swept chunk still played")
+	}
+}
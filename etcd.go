@@ -1,27 +1,74 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
 
 	"context"
 
 	"github.com/coreos/etcd/client"
 )
 
+func init() {
+	RegisterDriver(&Driver{
+		Name:         "etcd",
+		Capabilities: CapPresets | CapTapes | CapTTL | CapWatch | CapKeys,
+		Settings:     []string{"database.host", "database.port", "database.tls", "database.tls_ca_file"},
+		Schemes:      []string{"etcd", "etcds"},
+		Open: func(c *Config) (Backend, error) {
+			tlsConfig, err := c.DBTLSConfig()
+			if err != nil {
+				return nil, err
+			}
+			return &EtcdBackend{
+				host:   c.DBHost,
+				port:   c.DBPort,
+				tls:    tlsConfig,
+				policy: c.OpPolicy("etcd"),
+			}, nil
+		},
+		FromURL: func(u *url.URL) (Backend, error) {
+			port, err := urlPort(u, 2379)
+			if err != nil {
+				return nil, err
+			}
+			b := &EtcdBackend{host: u.Hostname(), port: port, policy: DefaultOpPolicies["etcd"]}
+			if u.Scheme == "etcds" {
+				b.tls = &tls.Config{ServerName: b.host}
+			}
+			return b, nil
+		},
+	})
+}
+
 // A EtcdBackend implements Backend and connects to etcd
 // with a 24h expiration on stored entries
 type EtcdBackend struct {
 	host   string
 	port   int
+	tls    *tls.Config
+	policy OpPolicy
 	client client.Client
 }
 
 // Implements Backend
 func (b *EtcdBackend) Init() error {
-	ep := fmt.Sprintf("http://%s:%d", b.host, b.port)
+	scheme, transport := "http", client.DefaultTransport
+	if b.tls != nil {
+		scheme = "https"
+		transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: b.tls,
+		}
+	}
 	cfg := client.Config{
-		Endpoints: []string{ep},
-		Transport: client.DefaultTransport,
+		Endpoints: []string{fmt.Sprintf("%s://%s:%d", scheme, b.host, b.port)},
+		Transport: transport,
 	}
 	c, err := client.New(cfg)
 	if err != nil {
@@ -31,12 +78,19 @@ func (b *EtcdBackend) Init() error {
 	return nil
 }
 
+// Implements Pinger
+func (b *EtcdBackend) Ping(ctx context.Context) error {
+	_, err := b.client.GetVersion(ctx)
+	return err
+}
+
 // Implements RecordedTape
 func (b *EtcdBackend) RecordedTape(ctx context.Context, name string, i Incrementer) (*RecordedTape, error) {
 	return &RecordedTape{
 		tape: &EtcdTape{
 			name:   name,
 			i:      i,
+			policy: b.policy,
 			client: b.client,
 		},
 	}, nil
@@ -48,34 +102,161 @@ func (b *EtcdBackend) BlankTape(ctx context.Context, name string, i Incrementer)
 		tape: &EtcdTape{
 			name:   name,
 			i:      i,
+			policy: b.policy,
 			client: b.client,
 		},
 	}, nil
 }
 
+// Implements ChunkDeleter
+func (b *EtcdBackend) DeleteChunk(ctx context.Context, name string, cue time.Time) error {
+	kAPI := client.NewKeysAPI(b.client)
+	key := cue.UTC().Format(time.RFC3339)
+	for _, k := range []string{"/chunk/%s/%s", "/chunkmeta/%s/%s"} {
+		_, err := kAPI.Delete(ctx, fmt.Sprintf(k, name, key), nil)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 // A EtcdTape implements BlankTape and RecordedTape
 // and stores entries with an expiration according to TTL
 type EtcdTape struct {
 	name   string
 	i      Incrementer
+	policy OpPolicy
 	client client.Client
 }
 
-func (t *EtcdTape) Write(data []byte) error {
+func (t *EtcdTape) Write(ctx context.Context, data []byte, meta ChunkMeta) error {
 	kAPI := client.NewKeysAPI(t.client)
-	k := fmt.Sprintf("/chunk/%s/%s", t.name, t.i.Key())
-	_, err := kAPI.Set(context.Background(), k, string(data), &client.SetOptions{TTL: TTL})
-	return err
+	key := t.i.Key()
+	return t.policy.Do(ctx, func(ctx context.Context) error {
+		k := fmt.Sprintf("/chunk/%s/%s", t.name, key)
+		if _, err := kAPI.Set(ctx, k, string(data), &client.SetOptions{TTL: TTL}); err != nil {
+			return err
+		}
+
+		m, err := json.Marshal(meta)
+		if err != nil {
+			return Permanent(err)
+		}
+		k = fmt.Sprintf("/chunkmeta/%s/%s", t.name, key)
+		_, err = kAPI.Set(ctx, k, string(m), &client.SetOptions{TTL: TTL})
+		return err
+	})
 }
 
-func (t *EtcdTape) Read() ([]byte, error) {
+func (t *EtcdTape) Read(ctx context.Context) ([]byte, *ChunkMeta, error) {
 	kAPI := client.NewKeysAPI(t.client)
-	k := fmt.Sprintf("/chunk/%s/%s", t.name, t.i.Key())
-	r, err := kAPI.Get(context.Background(), k, nil)
+	key := t.i.Key()
+	k := fmt.Sprintf("/chunk/%s/%s", t.name, key)
+	var data []byte
+	err := t.policy.Do(ctx, func(ctx context.Context) error {
+		r, err := kAPI.Get(ctx, k, nil)
+		if err != nil {
+			if client.IsKeyNotFound(err) {
+				return Permanent(err)
+			}
+			return err
+		}
+		return keep(ctx, func() { data = []byte(r.Node.Value) })
+	})
 	if err != nil {
-		return []byte{}, err
+		return nil, nil, err
 	}
-	return []byte(r.Node.Value), nil
+
+	k = fmt.Sprintf("/chunkmeta/%s/%s", t.name, key)
+	var meta *ChunkMeta
+	err = t.policy.Do(ctx, func(ctx context.Context) error {
+		r, err := kAPI.Get(ctx, k, nil)
+		if client.IsKeyNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		m := &ChunkMeta{}
+		if err := json.Unmarshal([]byte(r.Node.Value), m); err != nil {
+			return Permanent(err)
+		}
+		return keep(ctx, func() { meta = m })
+	})
+	return data, meta, err
+}
+
+// Implements TapeBackend. etcd v2 cannot get keys without their
+// values, so chunks are listed by the small metadata written with each
+func (b *EtcdBackend) ListChunks(ctx context.Context, name string, from, to time.Time) ([]time.Time, error) {
+	kAPI := client.NewKeysAPI(b.client)
+	r, err := kAPI.Get(ctx, fmt.Sprintf("/chunkmeta/%s", name), &client.GetOptions{Sort: true})
+	if client.IsKeyNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []time.Time
+	for _, n := range r.Node.Nodes {
+		t, ok := chunkTime(path.Base(n.Key))
+		if ok && !t.Before(from) && t.Before(to) {
+			chunks = append(chunks, t)
+		}
+	}
+	return chunks, nil
+}
+
+// Implements KeyMigrator
+func (b *EtcdBackend) MigrateKeys(ctx context.Context, dryrun bool) (n, collided int, err error) {
+	kAPI := client.NewKeysAPI(b.client)
+
+	for _, dir := range []string{"/chunk", "/chunkmeta"} {
+		r, err := kAPI.Get(ctx, dir, &client.GetOptions{Recursive: true})
+		if err != nil {
+			if client.IsKeyNotFound(err) {
+				continue
+			}
+			return n, collided, err
+		}
+
+		exists := map[string]bool{}
+		for _, station := range r.Node.Nodes {
+			for _, node := range station.Nodes {
+				exists[node.Key] = true
+			}
+		}
+
+		for _, station := range r.Node.Nodes {
+			for _, node := range station.Nodes {
+				canonical, changed, err := CanonicalKey(node.Key)
+				if err != nil || !changed {
+					continue
+				}
+				if exists[canonical] {
+					collided++
+					continue
+				}
+				if !dryrun {
+					ttl := time.Duration(node.TTL) * time.Second
+					_, err := kAPI.Set(ctx, canonical, node.Value, &client.SetOptions{TTL: ttl, PrevExist: client.PrevNoExist})
+					if e, ok := err.(client.Error); ok && e.Code == client.ErrorCodeNodeExist {
+						collided++
+						continue
+					} else if err != nil {
+						return n, collided, err
+					}
+					if _, err := kAPI.Delete(ctx, node.Key, nil); err != nil {
+						return n, collided, err
+					}
+				}
+				exists[canonical] = true
+				n++
+			}
+		}
+	}
+	return n, collided, nil
 }
 
 // Implements PresetBackend
@@ -104,9 +285,102 @@ func (b *EtcdBackend) ReadAllPresets() (data [][]byte, err error) {
 	return
 }
 
+// ListPresets pages through the presets in name order. etcd v2
+// cannot limit a get, so the whole directory is read each page
+func (b *EtcdBackend) ListPresets(cursor string, limit int) (data [][]byte, next string, err error) {
+	kAPI := client.NewKeysAPI(b.client)
+	r, err := kAPI.Get(context.Background(), "/preset", &client.GetOptions{Recursive: true, Sort: true})
+	if client.IsKeyNotFound(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, n := range r.Node.Nodes {
+		name := path.Base(n.Key)
+		if name <= cursor {
+			continue
+		}
+		if len(data) == limit {
+			return data, next, nil
+		}
+		data = append(data, []byte(n.Value))
+		next = name
+	}
+	return data, "", nil
+}
+
 func (b *EtcdBackend) WritePreset(name string, data []byte) error {
 	kAPI := client.NewKeysAPI(b.client)
 	k := fmt.Sprintf("/preset/%s", name)
-	_, err := kAPI.Create(context.Background(), k, string(data))
+	_, err := kAPI.Set(context.Background(), k, string(data), nil)
 	return err
 }
+
+// Implements KeyBackend
+func (b *EtcdBackend) ReadKey(hash string) (data []byte, err error) {
+	kAPI := client.NewKeysAPI(b.client)
+	k := fmt.Sprintf("/apikey/%s", hash)
+	r, err := kAPI.Get(context.Background(), k, nil)
+	if client.IsKeyNotFound(err) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(r.Node.Value), nil
+}
+
+func (b *EtcdBackend) WriteKey(hash string, data []byte) error {
+	kAPI := client.NewKeysAPI(b.client)
+	k := fmt.Sprintf("/apikey/%s", hash)
+	_, err := kAPI.Set(context.Background(), k, string(data), nil)
+	return err
+}
+
+// WatchPresets sends presets as the watch on /preset sees them
+// change, from the etcd index when the watch was ready
+func (b *EtcdBackend) WatchPresets(ctx context.Context, ready func(), changes chan<- PresetChange) error {
+	kAPI := client.NewKeysAPI(b.client)
+
+	var index uint64
+	r, err := kAPI.Get(ctx, "/preset", nil)
+	switch {
+	case err == nil:
+		index = r.Index
+	case client.IsKeyNotFound(err):
+		index = err.(client.Error).Index
+	case ctx.Err() != nil:
+		return nil
+	default:
+		return err
+	}
+	w := kAPI.Watcher("/preset", &client.WatcherOptions{AfterIndex: index, Recursive: true})
+	ready()
+
+	for {
+		r, err := w.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if r.Node.Dir {
+			continue
+		}
+
+		c := PresetChange{Name: path.Base(r.Node.Key)}
+		switch r.Action {
+		case "delete", "compareAndDelete", "expire":
+		default:
+			c.Data = []byte(r.Node.Value)
+		}
+		select {
+		case changes <- c:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// fakeEtcd serves the parts of the etcd v2 keys api the backend
+// uses from a map, counting the bytes of its responses
+type fakeEtcd struct {
+	mu    sync.Mutex
+	keys  map[string]string
+	index uint64
+	sent  int
+}
+
+func (f *fakeEtcd) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(req.URL.Path, "/v2/keys")
+	status, resp := http.StatusOK, interface{}(nil)
+	notFound := client.Error{Code: client.ErrorCodeKeyNotFound, Message: "Key not found", Cause: key, Index: f.index}
+
+	switch req.Method {
+	case http.MethodGet:
+		if node := f.node(key, req.FormValue("recursive") == "true", true); node != nil {
+			resp = client.Response{Action: "get", Node: node}
+		} else {
+			status, resp = http.StatusNotFound, notFound
+		}
+	case http.MethodPut:
+		if _, ok := f.keys[key]; ok && req.FormValue("prevExist") == "false" {
+			status, resp = http.StatusPreconditionFailed, client.Error{Code: client.ErrorCodeNodeExist, Message: "Key already exists", Cause: key, Index: f.index}
+			break
+		}
+		f.index++
+		f.keys[key] = req.FormValue("value")
+		status, resp = http.StatusCreated, client.Response{Action: "set", Node: f.node(key, false, false)}
+	case http.MethodDelete:
+		if _, ok := f.keys[key]; !ok {
+			status, resp = http.StatusNotFound, notFound
+			break
+		}
+		f.index++
+		delete(f.keys, key)
+		resp = client.Response{Action: "delete", Node: &client.Node{Key: key, ModifiedIndex: f.index}}
+	}
+
+	body, _ := json.Marshal(resp)
+	f.sent += len(body)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Etcd-Index", strconv.FormatUint(f.index, 10))
+	rw.WriteHeader(status)
+	rw.Write(body)
+}
+
+// node returns the key's node, or the directory of keys under it
+// with their children when expanded
+func (f *fakeEtcd) node(key string, recursive, expand bool) *client.Node {
+	if v, ok := f.keys[key]; ok {
+		return &client.Node{Key: key, Value: v, ModifiedIndex: f.index}
+	}
+
+	prefix := strings.TrimSuffix(key, "/") + "/"
+	children := map[string]bool{}
+	for k := range f.keys {
+		if strings.HasPrefix(k, prefix) {
+			children[prefix+strings.SplitN(strings.TrimPrefix(k, prefix), "/", 2)[0]] = true
+		}
+	}
+	if len(children) == 0 {
+		return nil
+	}
+	dir := &client.Node{Key: key, Dir: true, ModifiedIndex: f.index}
+	if !expand {
+		return dir
+	}
+	var names []string
+	for k := range children {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		dir.Nodes = append(dir.Nodes, f.node(k, recursive, recursive))
+	}
+	return dir
+}
+
+// fetched returns the bytes sent since it was last called
+func (f *fakeEtcd) fetched() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.sent
+	f.sent = 0
+	return n
+}
+
+func newFakeEtcdBackend(t *testing.T) (*EtcdBackend, *fakeEtcd, func()) {
+	f := &fakeEtcd{keys: map[string]string{}}
+	s := httptest.NewServer(f)
+	u := strings.Split(strings.TrimPrefix(s.URL, "http://"), ":")
+	port, _ := strconv.Atoi(u[1])
+	b := &EtcdBackend{host: u[0], port: port, policy: DefaultOpPolicies["etcd"]}
+	if err := b.Init(); err != nil {
+		s.Close()
+		t.Fatalf("Init() failed: %v", err)
+	}
+	return b, f, s.Close
+}
+
+func TestEtcdListChunks(t *testing.T) {
+	b, f, done := newFakeEtcdBackend(t)
+	defer done()
+	ctx := context.Background()
+	cue := time.Date(2017, 7, 30, 10, 0, 0, 0, time.UTC)
+
+	chunk := bytes.Repeat([]byte{0xff}, 64*1024)
+	blank, _ := b.BlankTape(ctx, "wamc", Incrementer{cue})
+	for i := 0; i < 3; i++ {
+		if _, err := blank.Write(chunk); err != nil {
+			t.Fatalf("BlankTape Write() failed: %v", err)
+		}
+	}
+
+	f.fetched()
+	chunks, err := b.ListChunks(ctx, "wamc", cue, cue.Add(time.Hour))
+	if err != nil || len(chunks) != 3 || !chunks[0].Equal(cue) {
+		t.Fatalf("ListChunks() = %v, %v", chunks, err)
+	}
+	if n := f.fetched(); n >= len(chunk) {
+		t.Errorf("ListChunks() fetched %d bytes, the size of the chunks", n)
+	}
+
+	if chunks, err := b.ListChunks(ctx, "kexp", cue, cue.Add(time.Hour)); err != nil || len(chunks) != 0 {
+		t.Errorf("ListChunks() of an unrecorded station = %v, %v", chunks, err)
+	}
+}
+
+func TestEtcdCopyPresets(t *testing.T) {
+	b, f, done := newFakeEtcdBackend(t)
+	defer done()
+	from := &testPresetBackend{data: map[string][]byte{
+		"wamc": []byte(`{"name":"wamc","url":"http://wamc","location":"America/New_York"}`),
+		"wkrp": []byte(`{"name":"wkrp","url":"http://wkrp","location":"America/New_York"}`),
+	}}
+
+	// a rerun overwrites the presets it already copied
+	for run := 0; run < 2; run++ {
+		if n, err := CopyPresets(from, b, false); err != nil || n != 2 {
+			t.Fatalf("CopyPresets() run %d = %d, %v", run, n, err)
+		}
+		from.data["wkrp"] = []byte(`{"name":"wkrp","url":"http://wkrp.fm","location":"America/New_York"}`)
+	}
+	if d, err := b.ReadPreset("wkrp"); err != nil || !strings.Contains(string(d), "wkrp.fm") {
+		t.Errorf("preset not overwritten: %s, %v", d, err)
+	}
+	if len(f.keys) != 2 {
+		t.Errorf("copied presets wrong: %v", f.keys)
+	}
+}
+
+func TestEtcdMigrateKeys(t *testing.T) {
+	b, f, done := newFakeEtcdBackend(t)
+	defer done()
+	f.keys["/chunk/wamc/2017-07-30T06:13:00-04:00"] = "legacy"
+	f.keys["/chunk/wamc/2017-07-30T06:13:10-04:00"] = "stale"
+	f.keys["/chunk/wamc/2017-07-30T10:13:10Z"] = "newer"
+
+	for _, dryrun := range []bool{true, false} {
+		n, collided, err := b.MigrateKeys(context.Background(), dryrun)
+		if err != nil || n != 1 || collided != 1 {
+			t.Fatalf("MigrateKeys(%v) = %d, %d, %v", dryrun, n, collided, err)
+		}
+	}
+	if v := f.keys["/chunk/wamc/2017-07-30T10:13:00Z"]; v != "legacy" {
+		t.Errorf("legacy chunk not migrated: %q", v)
+	}
+	if v := f.keys["/chunk/wamc/2017-07-30T10:13:10Z"]; v != "newer" {
+		t.Errorf("colliding chunk replaced: %q", v)
+	}
+}
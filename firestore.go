@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// FirestoreEndpoint serves the Firestore REST API
+const FirestoreEndpoint = "https://firestore.googleapis.com/v1"
+
+// errPresetNotFound is returned for presets that aren't stored
+var errPresetNotFound = errors.New("preset not found")
+
+func init() {
+	RegisterDriver(&Driver{
+		Name:         "firestore",
+		Capabilities: CapPresets | CapListing | CapKeys,
+		Settings:     []string{"google.project", "google.credentials_file"},
+		Schemes:      []string{"firestore"},
+		Open: func(c *Config) (Backend, error) {
+			return &FirestoreBackend{project: c.GoogleProject, opts: c.GoogleOptions()}, nil
+		},
+		FromURL: func(u *url.URL) (Backend, error) {
+			return &FirestoreBackend{project: u.Host}, nil
+		},
+	})
+}
+
+// FirestoreBackend implements PresetBackend with a document
+// for each preset in the presets collection of a native mode
+// Firestore database
+type FirestoreBackend struct {
+	project string // falls back to GOOGLE_CLOUD_PROJECT
+	opts    []option.ClientOption
+
+	// endpoint and client are set by Init, to the emulator
+	// at FIRESTORE_EMULATOR_HOST if it is set
+	endpoint string
+	client   *http.Client
+	emulator bool
+}
+
+// A firestoreDocument holds a preset or api key in its value field
+type firestoreDocument struct {
+	Name   string `json:"name,omitempty"`
+	Fields struct {
+		Value struct {
+			BytesValue []byte `json:"bytesValue"`
+		} `json:"value"`
+	} `json:"fields"`
+}
+
+type firestoreList struct {
+	Documents     []firestoreDocument `json:"documents"`
+	NextPageToken string              `json:"nextPageToken"`
+}
+
+// Implements Backend
+func (b *FirestoreBackend) Init() error {
+	if b.project == "" {
+		b.project = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	if b.project == "" {
+		return fmt.Errorf("no google cloud project for firestore")
+	}
+
+	if host := os.Getenv("FIRESTORE_EMULATOR_HOST"); host != "" {
+		b.endpoint, b.client, b.emulator = "http://"+host+"/v1", http.DefaultClient, true
+	} else {
+		opts := append([]option.ClientOption{
+			option.WithScopes("https://www.googleapis.com/auth/datastore"),
+		}, b.opts...)
+		client, _, err := htransport.NewClient(context.Background(), opts...)
+		if err != nil {
+			return err
+		}
+		b.endpoint, b.client = FirestoreEndpoint, client
+	}
+
+	return b.Ping(context.Background())
+}
+
+// Implements Pinger
+func (b *FirestoreBackend) Ping(ctx context.Context) error {
+	_, err := b.list(ctx, "", 1)
+	return err
+}
+
+// url returns the url of a collection, or of a document in it
+func (b *FirestoreBackend) url(collection, name string) string {
+	u := fmt.Sprintf("%s/projects/%s/databases/(default)/documents/%s", b.endpoint, b.project, collection)
+	if name != "" {
+		u += "/" + url.PathEscape(name)
+	}
+	return u
+}
+
+// do sends a request and decodes a successful json response into v
+func (b *FirestoreBackend) do(ctx context.Context, method, u string, body io.Reader, v interface{}) error {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if b.emulator {
+		// the emulator skips security rules for its owner
+		req.Header.Set("Authorization", "Bearer owner")
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errPresetNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("firestore %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// list returns a page of preset documents in name order
+func (b *FirestoreBackend) list(ctx context.Context, token string, limit int) (*firestoreList, error) {
+	q := url.Values{}
+	q.Set("pageSize", strconv.Itoa(limit))
+	q.Set("orderBy", "__name__")
+	if token != "" {
+		q.Set("pageToken", token)
+	}
+
+	l := &firestoreList{}
+	if err := b.do(ctx, http.MethodGet, b.url("presets", "")+"?"+q.Encode(), nil, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Implements PresetBackend
+func (b *FirestoreBackend) ReadPreset(name string) ([]byte, error) {
+	var d firestoreDocument
+	if err := b.do(context.Background(), http.MethodGet, b.url("presets", name), nil, &d); err != nil {
+		return nil, err
+	}
+	return d.Fields.Value.BytesValue, nil
+}
+
+func (b *FirestoreBackend) ReadAllPresets() (data [][]byte, err error) {
+	cursor := ""
+	for {
+		page, next, err := b.ListPresets(cursor, presetPageSize)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, page...)
+		if next == "" {
+			return data, nil
+		}
+		cursor = next
+	}
+}
+
+// ListPresets pages through the presets with firestore page tokens
+func (b *FirestoreBackend) ListPresets(cursor string, limit int) (data [][]byte, next string, err error) {
+	l, err := b.list(context.Background(), cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, d := range l.Documents {
+		data = append(data, d.Fields.Value.BytesValue)
+	}
+	return data, l.NextPageToken, nil
+}
+
+func (b *FirestoreBackend) WritePreset(name string, data []byte) error {
+	var d firestoreDocument
+	d.Fields.Value.BytesValue = data
+	body, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	// patching a document creates it if it is missing
+	return b.do(context.Background(), http.MethodPatch, b.url("presets", name), bytes.NewReader(body), &d)
+}
+
+// Implements KeyBackend with a document for each key
+// in the apikeys collection
+func (b *FirestoreBackend) ReadKey(hash string) ([]byte, error) {
+	var d firestoreDocument
+	err := b.do(context.Background(), http.MethodGet, b.url("apikeys", hash), nil, &d)
+	if err == errPresetNotFound {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.Fields.Value.BytesValue, nil
+}
+
+func (b *FirestoreBackend) WriteKey(hash string, data []byte) error {
+	var d firestoreDocument
+	d.Fields.Value.BytesValue = data
+	body, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return b.do(context.Background(), http.MethodPatch, b.url("apikeys", hash), bytes.NewReader(body), &d)
+}
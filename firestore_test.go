@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testFirestore serves the parts of the firestore REST api
+// the preset backend uses
+type testFirestore struct {
+	docs map[string][]byte
+}
+
+func (f *testFirestore) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	const collection = "/v1/projects/rtm/databases/(default)/documents/presets"
+	if req.Header.Get("Authorization") != "Bearer owner" {
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, collection), "/")
+	switch {
+	case req.Method == http.MethodPatch:
+		body, _ := ioutil.ReadAll(req.Body)
+		f.docs[name] = body
+		rw.Write(body)
+	case name != "":
+		doc, ok := f.docs[name]
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Write(doc)
+	default:
+		names := []string{}
+		for n := range f.docs {
+			if n > req.URL.Query().Get("pageToken") {
+				names = append(names, n)
+			}
+		}
+		sort.Strings(names)
+		l := struct {
+			Documents     []json.RawMessage `json:"documents"`
+			NextPageToken string            `json:"nextPageToken,omitempty"`
+		}{}
+		size, _ := strconv.Atoi(req.URL.Query().Get("pageSize"))
+		if len(names) > size {
+			names, l.NextPageToken = names[:size], names[size-1]
+		}
+		for _, n := range names {
+			l.Documents = append(l.Documents, f.docs[n])
+		}
+		json.NewEncoder(rw).Encode(l)
+	}
+}
+
+func TestFirestoreBackend(t *testing.T) {
+	s := httptest.NewServer(&testFirestore{docs: map[string][]byte{}})
+	defer s.Close()
+
+	host := os.Getenv("FIRESTORE_EMULATOR_HOST")
+	os.Setenv("FIRESTORE_EMULATOR_HOST", strings.TrimPrefix(s.URL, "http://"))
+	defer os.Setenv("FIRESTORE_EMULATOR_HOST", host)
+
+	b := &FirestoreBackend{project: "rtm"}
+	if err := b.Init(); err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+
+	for _, name := range []string{"wamc", "wkrp", "wnyc"} {
+		if err := b.WritePreset(name, []byte(name)); err != nil {
+			t.Fatalf("WritePreset() failed: %v", err)
+		}
+	}
+	if d, err := b.ReadPreset("wkrp"); err != nil || !bytes.Equal(d, []byte("wkrp")) {
+		t.Errorf("ReadPreset() = %q, %v", d, err)
+	}
+	if _, err := b.ReadPreset("kexp"); err != errPresetNotFound {
+		t.Errorf("ReadPreset() of a missing preset = %v", err)
+	}
+
+	page, next, err := b.ListPresets("", 2)
+	if err != nil || len(page) != 2 || next == "" {
+		t.Fatalf("ListPresets() = %q, %q, %v", page, next, err)
+	}
+	if page, next, err = b.ListPresets(next, 2); err != nil || len(page) != 1 || next != "" {
+		t.Errorf("ListPresets() second page = %q, %q, %v", page, next, err)
+	}
+	if all, err := b.ReadAllPresets(); err != nil || len(all) != 3 {
+		t.Errorf("ReadAllPresets() = %q, %v", all, err)
+	}
+}
@@ -3,58 +3,275 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
 
 	"context"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
-// A GCSBackend implements Backend and connects to google cloud storage
+func init() {
+	RegisterDriver(&Driver{
+		Name:         "gcs",
+		Capabilities: CapTapes | CapListing,
+		Settings:     []string{"storage.bucket", "storage.retention", "storage.lifecycle", "google.credentials_file"},
+		Schemes:      []string{"gcs"},
+		Validate: func(c *Config) []error {
+			if c.Bucket == "" {
+				return []error{fmt.Errorf("storage.bucket: required for the gcs driver")}
+			}
+			return nil
+		},
+		Open: func(c *Config) (Backend, error) {
+			return &GCSBackend{
+				bucket:    c.Bucket,
+				opts:      c.GoogleOptions(),
+				policy:    c.OpPolicy("gcs"),
+				retention: c.Retention,
+				lifecycle: c.Lifecycle,
+			}, nil
+		},
+		FromURL: func(u *url.URL) (Backend, error) {
+			return &GCSBackend{bucket: u.Host, policy: DefaultOpPolicies["gcs"]}, nil
+		},
+	})
+}
+
+// A GCSBackend implements Backend and connects to google cloud storage.
+// Chunks older than the retention are deleted by a lifecycle rule on
+// the bucket, if it is installed, or by the Sweep
 type GCSBackend struct {
-	bucket string
+	bucket    string
+	opts      []option.ClientOption
+	policy    OpPolicy
+	retention time.Duration // TTL if zero
+	lifecycle bool
+	client    *storage.Client
 }
 
 // Implements Backend
 func (b *GCSBackend) Init() error {
-	client, err := storage.NewClient(context.Background())
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx, b.opts...)
 	if err != nil {
 		return err
 	}
+	b.client = client
+	if b.retention == 0 {
+		b.retention = TTL
+	}
+
+	if err := b.Ping(ctx); err != nil {
+		return err
+	}
+	if b.lifecycle {
+		return b.installLifecycle(ctx)
+	}
+	return nil
+}
 
-	handle := client.Bucket(b.bucket)
-	_, err = handle.Attrs(context.Background())
+// Close releases the storage client
+func (b *GCSBackend) Close() error {
+	return b.client.Close()
+}
 
+// Implements Pinger
+func (b *GCSBackend) Ping(ctx context.Context) error {
+	_, err := b.client.Bucket(b.bucket).Attrs(ctx)
 	return err
 }
 
+// installLifecycle adds a rule deleting objects older than the
+// retention, in whole days, keeping the bucket's other rules
+func (b *GCSBackend) installLifecycle(ctx context.Context) error {
+	handle := b.client.Bucket(b.bucket)
+	attrs, err := handle.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+
+	days := int64((b.retention + 24*time.Hour - 1) / (24 * time.Hour))
+	rules, changed, err := lifecycleRules(attrs.Lifecycle.Rules, days)
+	if err != nil || !changed {
+		return err
+	}
+	_, err = handle.Update(ctx, storage.BucketAttrsToUpdate{
+		Lifecycle: &storage.Lifecycle{Rules: rules},
+	})
+	return err
+}
+
+// lifecycleRules adds a rule deleting objects after days to the
+// existing rules. It refuses to replace a different age-based
+// delete rule, which somebody else may rely on
+func lifecycleRules(existing []storage.LifecycleRule, days int64) ([]storage.LifecycleRule, bool, error) {
+	for _, r := range existing {
+		if r.Action.Type == storage.DeleteAction && r.Condition.AgeInDays > 0 &&
+			r.Condition.CreatedBefore.IsZero() && len(r.Condition.MatchesStorageClasses) == 0 {
+			if r.Condition.AgeInDays == days {
+				return existing, false, nil
+			}
+			return nil, false, fmt.Errorf("bucket already deletes objects after %d days, not %d; remove that rule or disable storage.lifecycle", r.Condition.AgeInDays, days)
+		}
+	}
+	rule := storage.LifecycleRule{
+		Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+		Condition: storage.LifecycleCondition{AgeInDays: days},
+	}
+	return append([]storage.LifecycleRule{rule}, existing...), true, nil
+}
+
 // Implements RecordedTape
 func (b GCSBackend) RecordedTape(ctx context.Context, name string, i Incrementer) (*RecordedTape, error) {
-	client, err := storage.NewClient(ctx)
-	handle := client.Bucket(b.bucket)
-
 	return &RecordedTape{
 		tape: &GCSTape{
-			ctx:    ctx,
-			handle: handle,
+			policy: b.policy,
+			handle: b.client.Bucket(b.bucket),
 			name:   name,
 			i:      i,
 		},
-	}, err
+	}, nil
 }
 
 // Implements BlankTape
 func (b GCSBackend) BlankTape(ctx context.Context, name string, i Incrementer) (*BlankTape, error) {
-	client, err := storage.NewClient(ctx)
-	handle := client.Bucket(b.bucket)
-
 	return &BlankTape{
 		tape: &GCSTape{
-			ctx:    ctx,
-			handle: handle,
+			policy: b.policy,
+			handle: b.client.Bucket(b.bucket),
 			name:   name,
 			i:      i,
 		},
-	}, err
+	}, nil
+}
+
+// Implements TapeBackend
+func (b GCSBackend) ListChunks(ctx context.Context, name string, from, to time.Time) ([]time.Time, error) {
+	// keys between from and to share a prefix that narrows the listing
+	f, l := from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339)
+	n := 0
+	for n < len(f) && n < len(l) && f[n] == l[n] {
+		n++
+	}
+	q := &storage.Query{Prefix: fmt.Sprintf("%s/%s", name, f[:n])}
+
+	var chunks []time.Time
+	it := b.client.Bucket(b.bucket).Objects(ctx, q)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		key := strings.TrimSuffix(strings.TrimPrefix(attrs.Name, name+"/"), ".chunk")
+		t, ok := chunkTime(key)
+		if ok && !t.Before(from) && t.Before(to) {
+			chunks = append(chunks, t)
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Before(chunks[j]) })
+	return chunks, nil
+}
+
+// Implements KeyMigrator
+func (b GCSBackend) MigrateKeys(ctx context.Context, dryrun bool) (n, collided int, err error) {
+	handle := b.client.Bucket(b.bucket)
+
+	it := handle.Objects(ctx, nil)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return n, collided, nil
+		}
+		if err != nil {
+			return n, collided, err
+		}
+		if !strings.HasSuffix(attrs.Name, ".chunk") {
+			continue
+		}
+
+		canonical, changed, err := CanonicalKey(strings.TrimSuffix(attrs.Name, ".chunk"))
+		if err != nil || !changed {
+			continue
+		}
+		dst := handle.Object(canonical + ".chunk")
+		if dryrun {
+			_, err = dst.Attrs(ctx)
+			if err == nil {
+				collided++
+				continue
+			} else if err != storage.ErrObjectNotExist {
+				return n, collided, err
+			}
+			n++
+			continue
+		}
+
+		src := handle.Object(attrs.Name)
+		_, err = dst.If(storage.Conditions{DoesNotExist: true}).CopierFrom(src).Run(ctx)
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusPreconditionFailed {
+			collided++
+			continue
+		} else if err != nil {
+			return n, collided, err
+		}
+		if err := src.Delete(ctx); err != nil {
+			return n, collided, err
+		}
+		n++
+	}
+}
+
+// Implements Sweeper, deleting {station}/{key}.chunk objects
+// recorded longer than the retention before now
+func (b *GCSBackend) Sweep(ctx context.Context, now time.Time) (int, error) {
+	handle := b.client.Bucket(b.bucket)
+	expired := now.Add(-b.retention)
+
+	n := 0
+	it := handle.Objects(ctx, nil)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		station, ok := sweepable(attrs.Name, expired)
+		if !ok {
+			continue
+		}
+		if err := handle.Object(attrs.Name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return n, err
+		}
+		metricChunksSwept.Add(1, station)
+		n++
+	}
+}
+
+// sweepable returns the station of a {station}/{key}.chunk
+// object recorded before expired
+func sweepable(object string, expired time.Time) (string, bool) {
+	parts := strings.Split(object, "/")
+	if len(parts) != 2 || !strings.HasSuffix(parts[1], ".chunk") {
+		return "", false
+	}
+	t, ok := chunkTime(strings.TrimSuffix(parts[1], ".chunk"))
+	if !ok || !t.Before(expired) {
+		return "", false
+	}
+	return parts[0], true
 }
 
 // A GCSTape implements BlankTape and RecordedTape
@@ -62,30 +279,61 @@ func (b GCSBackend) BlankTape(ctx context.Context, name string, i Incrementer) (
 type GCSTape struct {
 	name   string
 	i      Incrementer
+	policy OpPolicy
 	handle *storage.BucketHandle
-	ctx    context.Context
 }
 
-func (t *GCSTape) Write(data []byte) error {
+func (t *GCSTape) Write(ctx context.Context, data []byte, meta ChunkMeta) error {
 	name := fmt.Sprintf("%s/%s.chunk", t.name, t.i.Key())
-	w := t.handle.Object(name).NewWriter(t.ctx)
-	defer w.Close()
+	return t.policy.Do(ctx, func(ctx context.Context) error {
+		w := t.handle.Object(name).NewWriter(ctx)
+		w.Metadata = meta.Fields()
 
-	if _, err := w.Write(data); err != nil {
-		return err
-	}
+		if _, err := w.Write(data); err != nil {
+			w.Close()
+			return err
+		}
 
-	return nil
+		// the object is only uploaded on close
+		return w.Close()
+	})
 }
 
-func (t *GCSTape) Read() ([]byte, error) {
-	name := fmt.Sprintf("%s/%s.chunk", t.name, t.i.Key())
+func (t *GCSTape) Read(ctx context.Context) ([]byte, *ChunkMeta, error) {
+	obj := t.handle.Object(fmt.Sprintf("%s/%s.chunk", t.name, t.i.Key()))
+	var data []byte
+	var meta *ChunkMeta
+	err := t.policy.Do(ctx, func(ctx context.Context) error {
+		r, err := obj.NewReader(ctx)
+		if err == storage.ErrObjectNotExist {
+			return Permanent(err)
+		}
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		d, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
 
-	r, err := t.handle.Object(name).NewReader(t.ctx)
+		// the reader lacks custom metadata, so it comes from the
+		// generation just read, in case the chunk was rewritten since
+		attrs, err := obj.Generation(r.Attrs.Generation).Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			return Permanent(err)
+		} else if err != nil {
+			return err
+		}
+		m, err := ChunkMetaFromFields(attrs.Metadata)
+		if err != nil {
+			return Permanent(err)
+		}
+		return keep(ctx, func() { data, meta = d, m })
+	})
 	if err != nil {
-		return []byte{}, err
+		return nil, nil, err
 	}
-	defer r.Close()
-
-	return ioutil.ReadAll(r)
+	return data, meta, nil
 }
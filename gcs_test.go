@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestLifecycleRules(t *testing.T) {
+	del := func(days int64) storage.LifecycleRule {
+		return storage.LifecycleRule{
+			Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+			Condition: storage.LifecycleCondition{AgeInDays: days},
+		}
+	}
+	archive := storage.LifecycleRule{
+		Action: storage.LifecycleAction{
+			Type:         storage.SetStorageClassAction,
+			StorageClass: "ARCHIVE",
+		},
+		Condition: storage.LifecycleCondition{AgeInDays: 30},
+	}
+	coldline := del(3)
+	coldline.Condition.MatchesStorageClasses = []string{"COLDLINE"}
+
+	rules, changed, err := lifecycleRules(nil, 2)
+	if err != nil || !changed || len(rules) != 1 || rules[0].Condition.AgeInDays != 2 {
+		t.Errorf("lifecycleRules(nil, 2) = %v, %v, %v", rules, changed, err)
+	}
+
+	// other rules are kept
+	rules, changed, err = lifecycleRules([]storage.LifecycleRule{archive, coldline}, 2)
+	if err != nil || !changed || len(rules) != 3 {
+		t.Errorf("lifecycleRules(archive, coldline) = %v, %v, %v", rules, changed, err)
+	}
+
+	// an installed rule is left alone
+	rules, changed, err = lifecycleRules([]storage.LifecycleRule{archive, del(2)}, 2)
+	if err != nil || changed || len(rules) != 2 {
+		t.Errorf("lifecycleRules(archive, 2 days) = %v, %v, %v", rules, changed, err)
+	}
+
+	// a different age is not silently replaced
+	_, _, err = lifecycleRules([]storage.LifecycleRule{archive, del(7)}, 2)
+	if err == nil || !strings.Contains(err.Error(), "7 days") {
+		t.Errorf("lifecycleRules(7 days) = %v, want 7 days error", err)
+	}
+}
+
+func TestSweepable(t *testing.T) {
+	expired := time.Date(2017, 7, 30, 10, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		object  string
+		station string
+		ok      bool
+	}{
+		{"wamc/2017-07-30T09:59:50Z.chunk", "wamc", true},
+		{"wamc/2017-07-30T05:59:50-04:00.chunk", "wamc", true},
+		{"wamc/2017-07-30T10:00:00Z.chunk", "", false},
+		{"wamc/2017-07-30T10:00:10Z.chunk", "", false},
+		{"wamc/2017-07-30T09:59:50Z", "", false},
+		{"wamc/2017-07-30T09:59:50Z.json", "", false},
+		{"wamc/notes.chunk", "", false},
+		{"2017-07-30T09:59:50Z.chunk", "", false},
+		{"backup/wamc/2017-07-30T09:59:50Z.chunk", "", false},
+	}
+	for _, tt := range tests {
+		station, ok := sweepable(tt.object, expired)
+		if station != tt.station || ok != tt.ok {
+			t.Errorf("sweepable(%q) = %q, %v, want %q, %v", tt.object, station, ok, tt.station, tt.ok)
+		}
+	}
+}
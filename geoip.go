@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A GeoIPDB reads the time zone of an address from a database
+// in the MaxMind DB format, such as GeoLite2-City
+type GeoIPDB struct {
+	buf        []byte
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+}
+
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// OpenGeoIPDB reads the database file at path into memory
+func OpenGeoIPDB(path string) (*GeoIPDB, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewGeoIPDB(buf)
+}
+
+// NewGeoIPDB parses a database held in buf
+func NewGeoIPDB(buf []byte) (*GeoIPDB, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("no maxmind db metadata found")
+	}
+
+	meta := mmdbDecoder{buf: buf[i+len(mmdbMetadataMarker):]}
+	v, _, err := meta.decode(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding maxmind db metadata")
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("maxmind db metadata is not a map")
+	}
+
+	db := &GeoIPDB{buf: buf}
+	for key, field := range map[string]*uint{
+		"node_count":  &db.nodeCount,
+		"record_size": &db.recordSize,
+		"ip_version":  &db.ipVersion,
+	} {
+		n, ok := m[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("maxmind db metadata missing %s", key)
+		}
+		*field = uint(n)
+	}
+
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported maxmind db record size %d", db.recordSize)
+	}
+
+	// the search tree is followed by 16 zero bytes, then the data
+	treeSize := db.recordSize * 2 / 8 * db.nodeCount
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("maxmind db search tree is truncated")
+	}
+	db.tree = buf[:treeSize]
+	db.data = buf[treeSize+16 : i]
+	return db, nil
+}
+
+// TimeZone returns the name of the time zone for ip
+func (db *GeoIPDB) TimeZone(ip net.IP) (string, error) {
+	v, err := db.lookup(ip)
+	if err != nil {
+		return "", err
+	}
+
+	record, _ := v.(map[string]interface{})
+	location, _ := record["location"].(map[string]interface{})
+	zone, _ := location["time_zone"].(string)
+	if zone == "" {
+		return "", fmt.Errorf("no time zone for %s", ip)
+	}
+	return zone, nil
+}
+
+// lookup walks the search tree for ip and decodes its record
+func (db *GeoIPDB) lookup(ip net.IP) (interface{}, error) {
+	bits := ip.To4()
+	switch {
+	case bits != nil && db.ipVersion == 6:
+		// ipv4 addresses live under ::/96 in an ipv6 tree
+		bits = append(make(net.IP, 12), bits...)
+	case bits == nil && db.ipVersion == 4:
+		return nil, errors.New("ipv6 lookup in an ipv4 database")
+	case bits == nil:
+		bits = ip.To16()
+	}
+	if bits == nil {
+		return nil, fmt.Errorf("invalid address %s", ip)
+	}
+
+	node := uint(0)
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+
+	switch {
+	case node == db.nodeCount:
+		return nil, fmt.Errorf("no record for %s", ip)
+	case node < db.nodeCount:
+		return nil, errors.New("maxmind db search tree is corrupt")
+	}
+
+	d := mmdbDecoder{buf: db.data}
+	v, _, err := d.decode(node - db.nodeCount - 16)
+	return v, err
+}
+
+// record returns the left (0) or right (1) record of a node
+func (db *GeoIPDB) record(node, bit uint) uint {
+	size := db.recordSize / 4
+	b := db.tree[node*size : node*size+size]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3 : bit*3+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4 : bit*4+4]))
+	}
+}
+
+// mmdbDecoder decodes values in the maxmind db data section format
+type mmdbDecoder struct {
+	buf []byte
+}
+
+const (
+	mmdbPointer = 1 + iota
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+var errMMDBTruncated = errors.New("maxmind db data is truncated")
+
+// mmdbMaxDepth bounds the nesting of maps, arrays and pointers,
+// so corrupt data with pointer cycles cannot exhaust the stack
+const mmdbMaxDepth = 512
+
+// decode returns the value at offset and the offset following it
+func (d mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	return d.value(offset, 0)
+}
+
+// value decodes the value at offset, nested depth values deep
+func (d mmdbDecoder) value(offset, depth uint) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("maxmind db data is nested too deeply")
+	}
+	if offset >= uint(len(d.buf)) {
+		return nil, 0, errMMDBTruncated
+	}
+	ctrl := d.buf[offset]
+	offset++
+
+	kind := uint(ctrl >> 5)
+	if kind == mmdbPointer {
+		// pointers are followed to their value, but
+		// decoding resumes after the pointer itself
+		n := uint(ctrl>>3) & 0x3
+		ptr, err := d.uint(offset, n+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		vvv := uint(ctrl & 0x7)
+		switch n {
+		case 0:
+			ptr |= vvv << 8
+		case 1:
+			ptr = (ptr | vvv<<16) + 2048
+		case 2:
+			ptr = (ptr | vvv<<24) + 526336
+		}
+		if ptr < uint(len(d.buf)) && uint(d.buf[ptr]>>5) == mmdbPointer {
+			return nil, 0, errors.New("maxmind db pointer points to a pointer")
+		}
+		v, _, err := d.value(ptr, depth+1)
+		return v, offset + n + 1, err
+	}
+
+	if kind == 0 {
+		if offset >= uint(len(d.buf)) {
+			return nil, 0, errMMDBTruncated
+		}
+		kind = 7 + uint(d.buf[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		extra, err := d.uint(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		size = []uint{29, 285, 65821}[n-1] + extra
+	}
+
+	switch kind {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.value(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("maxmind db map key is not a string")
+			}
+			v, next, err := d.value(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.value(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errMMDBTruncated
+	}
+	b := d.buf[offset : offset+size]
+	offset += size
+
+	switch kind {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes, mmdbUint128:
+		return append([]byte{}, b...), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errors.New("maxmind db double is not 8 bytes")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errors.New("maxmind db float is not 4 bytes")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case mmdbInt32:
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown maxmind db data type %d", kind)
+}
+
+// uint reads an n byte big endian integer at offset
+func (d mmdbDecoder) uint(offset, n uint) (uint, error) {
+	if offset+n > uint(len(d.buf)) {
+		return 0, errMMDBTruncated
+	}
+	var v uint
+	for _, c := range d.buf[offset : offset+n] {
+		v = v<<8 | uint(c)
+	}
+	return v, nil
+}
+
+// A Locator infers a listener's time zone from their address
+type Locator struct {
+	DB             *GeoIPDB
+	TrustedProxies []*net.IPNet
+}
+
+// ParseCIDRs parses a comma separated list of networks,
+// where a bare address is a network of one
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ClientIP returns the address of the client that made the request,
+// taken from X-Forwarded-For when the request came through trusted proxies
+func (l *Locator) ClientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	// walk back through the proxies that appended to the header
+	var hops []string
+	for _, h := range req.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && l.trusted(ip); i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+func (l *Locator) trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Locate returns the time zone of the client that made the request
+func (l *Locator) Locate(req *http.Request) (*time.Location, error) {
+	ip := l.ClientIP(req)
+	if ip == nil {
+		return nil, errors.New("no client address")
+	}
+
+	zone, err := l.DB.TimeZone(ip)
+	if err != nil {
+		return nil, err
+	}
+	return time.LoadLocation(zone)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// encValue encodes the control byte and size for a data section value
+func encValue(kind int, size int) []byte {
+	b := []byte{byte(kind << 5)}
+	if kind > 7 {
+		b = []byte{0, byte(kind - 7)}
+	}
+	if size < 29 {
+		b[0] |= byte(size)
+		return b
+	}
+	b[0] |= 29
+	return append(b, byte(size-29))
+}
+
+func encString(s string) []byte {
+	return append(encValue(mmdbString, len(s)), s...)
+}
+
+func encUint(kind int, n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return append(encValue(kind, 4), b...)
+}
+
+func encPtr(offset int) []byte {
+	return []byte{byte(mmdbPointer<<5 | (offset>>8)&0x7), byte(offset)}
+}
+
+// testMMDB builds an ipv6 database with records of size bits
+// mapping networks to zones
+func testMMDB(t *testing.T, size int, zones map[string]string) []byte {
+	// the map keys are shared through pointers, as real databases do
+	data := append(encString("location"), encString("time_zone")...)
+	keyLocation, keyTimeZone := 0, len(encString("location"))
+
+	// nodes hold child node indices, or ^offset for data
+	nodes := [][2]int{{0, 0}}
+	for cidr, zone := range zones {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("bad test network %s", cidr)
+		}
+		ip := n.IP.To16()
+		ones, _ := n.Mask.Size()
+		if ip4 := n.IP.To4(); ip4 != nil {
+			ip = append(make(net.IP, 12), ip4...)
+			ones += 96
+		}
+
+		offset := len(data)
+		data = append(data, encValue(mmdbMap, 1)...)
+		data = append(data, encPtr(keyLocation)...)
+		data = append(data, encValue(mmdbMap, 1)...)
+		data = append(data, encPtr(keyTimeZone)...)
+		data = append(data, encString(zone)...)
+
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node][bit] = ^offset
+				break
+			}
+			if nodes[node][bit] <= 0 {
+				nodes = append(nodes, [2]int{0, 0})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var db bytes.Buffer
+	count := len(nodes)
+	for _, n := range nodes {
+		var v [2]int
+		for i, r := range n {
+			v[i] = count // no data
+			if r > 0 {
+				v[i] = r
+			} else if r < 0 {
+				v[i] = count + 16 + ^r
+			}
+		}
+		switch size {
+		case 24:
+			db.Write([]byte{byte(v[0] >> 16), byte(v[0] >> 8), byte(v[0]), byte(v[1] >> 16), byte(v[1] >> 8), byte(v[1])})
+		case 28:
+			// the middle byte holds the high nibble of each record
+			db.Write([]byte{byte(v[0] >> 16), byte(v[0] >> 8), byte(v[0]),
+				byte(v[0]>>20)&0xF0 | byte(v[1]>>24)&0x0F,
+				byte(v[1] >> 16), byte(v[1] >> 8), byte(v[1])})
+		case 32:
+			binary.Write(&db, binary.BigEndian, [2]uint32{uint32(v[0]), uint32(v[1])})
+		}
+	}
+	db.Write(make([]byte, 16))
+	db.Write(data)
+
+	db.Write(mmdbMetadataMarker)
+	db.Write(encValue(mmdbMap, 3))
+	db.Write(encString("node_count"))
+	db.Write(encUint(mmdbUint32, uint32(count)))
+	db.Write(encString("record_size"))
+	db.Write(encUint(mmdbUint16, uint32(size)))
+	db.Write(encString("ip_version"))
+	db.Write(encUint(mmdbUint16, 6))
+	return db.Bytes()
+}
+
+func TestGeoIPDB(t *testing.T) {
+	gts := []struct {
+		ip   string
+		zone string
+	}{
+		{"1.2.3.4", "America/New_York"},
+		{"5.6.7.8", "America/Argentina/Buenos_Aires"},
+		{"2001:db8::1", "Asia/Kolkata"},
+		{"1.2.4.1", ""},
+		{"2001:db9::1", ""},
+	}
+
+	for _, size := range []int{24, 28, 32} {
+		db, err := NewGeoIPDB(testMMDB(t, size, map[string]string{
+			"1.2.3.0/24":    "America/New_York",
+			"5.6.0.0/16":    "America/Argentina/Buenos_Aires",
+			"2001:db8::/32": "Asia/Kolkata",
+		}))
+		if err != nil {
+			t.Fatalf("NewGeoIPDB failed for %d bit records: %v", size, err)
+		}
+
+		for _, gt := range gts {
+			zone, err := db.TimeZone(net.ParseIP(gt.ip))
+			if gt.zone == "" {
+				if err == nil {
+					t.Errorf("expected no zone for %s in %d bit records, got %s", gt.ip, size, zone)
+				}
+				continue
+			}
+			if err != nil || zone != gt.zone {
+				t.Errorf("zone for %s wrong in %d bit records. expected %s, got %s: %v", gt.ip, size, gt.zone, zone, err)
+			}
+		}
+	}
+
+	if _, err := NewGeoIPDB([]byte("not a database")); err == nil {
+		t.Errorf("NewGeoIPDB accepted garbage")
+	}
+}
+
+func TestGeoIPDBRecord(t *testing.T) {
+	rts := []struct {
+		size        uint
+		node        []byte
+		left, right uint
+	}{
+		{24, []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc}, 0x123456, 0x789abc},
+		{28, []byte{0x12, 0x34, 0x56, 0xa7, 0x89, 0xab, 0xcd}, 0xa123456, 0x789abcd},
+		{32, []byte{0x81, 0x23, 0x45, 0x67, 0x08, 0x9a, 0xbc, 0xde}, 0x81234567, 0x089abcde},
+	}
+	for _, rt := range rts {
+		// the second node is read, past a first of zeros
+		db := &GeoIPDB{recordSize: rt.size, tree: append(make([]byte, len(rt.node)), rt.node...)}
+		if left, right := db.record(1, 0), db.record(1, 1); left != rt.left || right != rt.right {
+			t.Errorf("%d bit records wrong. expected %x %x, got %x %x", rt.size, rt.left, rt.right, left, right)
+		}
+	}
+}
+
+func TestMMDBDecoderCycles(t *testing.T) {
+	dts := map[string][]byte{
+		// a map whose value points back at the map
+		"cycle": append(append(encValue(mmdbMap, 1), encString("a")...), encPtr(0)...),
+		// a pointer to itself
+		"pointer": encPtr(0),
+		// arrays nested past the depth limit
+		"nested": bytes.Repeat(encValue(mmdbArray, 1), mmdbMaxDepth+2),
+	}
+	for name, data := range dts {
+		d := mmdbDecoder{buf: data}
+		if _, _, err := d.decode(0); err == nil {
+			t.Errorf("%s decoded without error", name)
+		}
+	}
+}
+
+func TestLocatorClientIP(t *testing.T) {
+	trusted, err := ParseCIDRs("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatalf("ParseCIDRs failed: %v", err)
+	}
+	l := &Locator{TrustedProxies: trusted}
+
+	cts := []struct {
+		remote string
+		xff    []string
+		client string
+	}{
+		{"1.2.3.4:5678", nil, "1.2.3.4"},
+		{"1.2.3.4:5678", []string{"9.9.9.9"}, "1.2.3.4"},
+		{"10.1.2.3:5678", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"10.1.2.3:5678", []string{"9.9.9.9, 1.2.3.4, 192.168.1.1"}, "1.2.3.4"},
+		{"10.1.2.3:5678", []string{"9.9.9.9", "1.2.3.4"}, "1.2.3.4"},
+		{"10.1.2.3:5678", []string{"10.9.9.9"}, "10.9.9.9"},
+		{"10.1.2.3:5678", []string{"garbage"}, "10.1.2.3"},
+	}
+
+	for i, ct := range cts {
+		req := &http.Request{RemoteAddr: ct.remote, Header: http.Header{}}
+		for _, h := range ct.xff {
+			req.Header.Add("X-Forwarded-For", h)
+		}
+		if ip := l.ClientIP(req); !ip.Equal(net.ParseIP(ct.client)) {
+			t.Errorf("client ip wrong. trial %d expected %s, got %s", i, ct.client, ip)
+		}
+	}
+}
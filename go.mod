@@ -17,6 +17,7 @@ require (
 	github.com/tcolgate/mp3 v0.0.0-20170426193717-e79c5a46d300
 	github.com/ugorji/go v1.1.4 // indirect
 	github.com/yuin/gopher-lua v0.0.0-20190206043414-8bfc7677f583 // indirect
+	go.opencensus.io v0.20.1
 	golang.org/x/net v0.0.0-20190420063019-afa5a82059c6
 	google.golang.org/api v0.3.2
 )
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var (
+	errNoRecordings    = errors.New("no chunks recorded")
+	errStaleRecordings = errors.New("no chunks recorded recently")
+)
+
+// PingTimeout bounds each backend check made for readiness
+const PingTimeout = 2 * time.Second
+
+// A ComponentStatus reports the health of one part of the radio
+type ComponentStatus struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// A HealthReport is served to liveness and readiness probes
+type HealthReport struct {
+	OK         bool                       `json:"ok"`
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+// Healthz reports that the process is alive
+func (r *Radio) Healthz(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusOK, HealthReport{OK: true})
+}
+
+// Readyz reports whether the backends are reachable and,
+// if configured, whether a station has recorded recently
+func (r *Radio) Readyz(rw http.ResponseWriter, req *http.Request) {
+	report := r.Readiness(req.Context(), time.Now())
+
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(rw, status, report)
+}
+
+// Readiness checks each component of the radio at now
+func (r *Radio) Readiness(ctx context.Context, now time.Time) HealthReport {
+	report := HealthReport{OK: true, Components: make(map[string]ComponentStatus)}
+	set := func(name string, err error) {
+		c := ComponentStatus{OK: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+			report.OK = false
+		}
+		report.Components[name] = c
+	}
+
+	set("presets", ping(ctx, r.Presets.backend))
+	set("tapes", ping(ctx, r.TapeDeck.backend))
+
+	if r.Options.Record && r.Options.ReadyChunkAge > 0 {
+		set("recorder", r.recentChunk(now, r.Options.ReadyChunkAge))
+	}
+	return report
+}
+
+// ping checks a backend that can be pinged
+func ping(ctx context.Context, backend interface{}) error {
+	p, ok := backend.(Pinger)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, PingTimeout)
+	defer cancel()
+	return p.Ping(ctx)
+}
+
+// recentChunk checks that some station still being recorded
+// wrote a chunk within age of now
+func (r *Radio) recentChunk(now time.Time, age time.Duration) error {
+	r.mu.Lock()
+	last, ok := metricLastChunk.Max(func(values []string) bool {
+		_, recording := r.recording[values[0]]
+		return recording
+	})
+	r.mu.Unlock()
+	if !ok {
+		return errNoRecordings
+	}
+	if t := time.Unix(int64(last), 0); now.Sub(t) > age {
+		return errStaleRecordings
+	}
+	return nil
+}
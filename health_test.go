@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testPingBackend struct {
+	testTapeBackend
+	err error
+}
+
+func (b *testPingBackend) Ping(ctx context.Context) error {
+	return b.err
+}
+
+func TestReadiness(t *testing.T) {
+	tapes := &testPingBackend{}
+	r := &Radio{
+		Presets:  &Presets{backend: &testPresetBackend{}},
+		TapeDeck: &TapeDeck{backend: tapes},
+		Options:  RadioOptions{Record: true, ReadyChunkAge: 5 * time.Minute},
+
+		recording: map[string]stopChan{"healthtest": nil},
+	}
+
+	recorded := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	metricLastChunk.Set(float64(recorded.Unix()), "healthtest")
+	defer metricLastChunk.Delete("healthtest")
+
+	// a station no longer recorded doesn't keep the radio ready
+	metricLastChunk.Set(float64(recorded.Add(time.Hour).Unix()), "healthgone")
+	defer metricLastChunk.Delete("healthgone")
+
+	rts := []struct {
+		now   time.Time
+		err   error
+		ready bool
+		bad   string
+	}{
+		{recorded.Add(time.Minute), nil, true, ""},
+		{recorded.Add(time.Hour), nil, false, "recorder"},
+		{recorded.Add(time.Minute), errors.New("down"), false, "tapes"},
+	}
+
+	for i, rt := range rts {
+		tapes.err = rt.err
+		report := r.Readiness(context.Background(), rt.now)
+		if report.OK != rt.ready {
+			t.Errorf("readiness wrong. trial %d expected %v, got %+v", i, rt.ready, report)
+		}
+		if rt.bad != "" && report.Components[rt.bad].OK {
+			t.Errorf("trial %d expected %s to fail, got %+v", i, rt.bad, report)
+		}
+	}
+
+	// probes get a status code and json
+	tapes.err = errors.New("down")
+	rec := httptest.NewRecorder()
+	r.Readyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	var report HealthReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("unable to decode report: %v", err)
+	}
+	if report.Components["tapes"].Error != "down" {
+		t.Errorf("expected tapes error in report, got %+v", report)
+	}
+}
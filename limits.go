@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StreamRetryAfter is when clients refused a stream are told to retry
+const StreamRetryAfter = 30 * time.Second
+
+// A LimitError refuses a client over a limit, with the limit
+// counted in metrics and when to retry
+type LimitError struct {
+	Limit      string // ip|key|station|preset_rate
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return e.Reason
+}
+
+// write refuses the request with a 429 and when to retry
+func (e *LimitError) write(rw http.ResponseWriter) {
+	metricLimited.Add(1, e.Limit)
+	secs := int(math.Ceil(e.RetryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	rw.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeJSON(rw, http.StatusTooManyRequests, &PathError{Err: e.Reason})
+}
+
+// A StreamLimiter caps concurrent streams for each client address,
+// each named listener and each station. A limit of 0 is no limit
+type StreamLimiter struct {
+	PerIP      int
+	PerKey     int
+	PerStation int
+
+	mu       sync.Mutex
+	ips      map[string]int
+	keys     map[string]int
+	stations map[string]int
+}
+
+// NewStreamLimiter caps the streams per address, listener and station
+func NewStreamLimiter(perIP, perKey, perStation int) *StreamLimiter {
+	return &StreamLimiter{
+		PerIP:      perIP,
+		PerKey:     perKey,
+		PerStation: perStation,
+		ips:        make(map[string]int),
+		keys:       make(map[string]int),
+		stations:   make(map[string]int),
+	}
+}
+
+// Acquire reserves a stream of the station for the client and
+// listener, returning the func that releases it. Anonymous and
+// unnamed signed listeners aren't limited as a listener
+func (l *StreamLimiter) Acquire(ip, listener, station string) (func(), *LimitError) {
+	named := listener != anonymousListener && listener != signedListener
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case l.PerIP > 0 && l.ips[ip] >= l.PerIP:
+		return nil, &LimitError{"ip", fmt.Sprintf("%d streams from one address at once", l.PerIP), StreamRetryAfter}
+	case named && l.PerKey > 0 && l.keys[listener] >= l.PerKey:
+		return nil, &LimitError{"key", fmt.Sprintf("%d streams for one api key at once", l.PerKey), StreamRetryAfter}
+	case l.PerStation > 0 && l.stations[station] >= l.PerStation:
+		return nil, &LimitError{"station", fmt.Sprintf("%s has its most listeners", station), StreamRetryAfter}
+	}
+
+	l.ips[ip]++
+	if named {
+		l.keys[listener]++
+	}
+	l.stations[station]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			release(l.ips, ip)
+			if named {
+				release(l.keys, listener)
+			}
+			release(l.stations, station)
+		})
+	}, nil
+}
+
+// release counts a stream ending, forgetting counts that reach zero
+func release(counts map[string]int, k string) {
+	if counts[k]--; counts[k] <= 0 {
+		delete(counts, k)
+	}
+}
+
+// A RateLimiter gives each client a bucket of tokens, refilled at
+// rate tokens a second up to burst, and takes one for each request
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter allows rate requests a second in bursts of up to burst
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token from the client's bucket at now, or
+// returns how long until the bucket has one
+func (l *RateLimiter) Allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// forget clients whose buckets have refilled
+	if now.Sub(l.pruned) > time.Minute {
+		for c, b := range l.buckets {
+			if b.refill(now, l.rate, l.burst) >= l.burst {
+				delete(l.buckets, c)
+			}
+		}
+		l.pruned = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	if b.refill(now, l.rate, l.burst) < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// refill adds the tokens earned since the bucket was last refilled
+func (b *bucket) refill(now time.Time, rate, burst float64) float64 {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*rate)
+		b.last = now
+	}
+	return b.tokens
+}
+
+// Limit refuses requests from clients, named by client,
+// that have run out of tokens
+func (l *RateLimiter) Limit(client func(*http.Request) string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if ok, wait := l.Allow(client(req), time.Now()); !ok {
+			e := &LimitError{"preset_rate", "too many preset requests", wait}
+			e.write(rw)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
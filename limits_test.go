@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStreamLimiter(t *testing.T) {
+	l := NewStreamLimiter(2, 1, 3)
+
+	lts := []struct {
+		ip, listener, station string
+		limit                 string
+	}{
+		{"10.0.0.1", anonymousListener, "wamc", ""},
+		{"10.0.0.1", anonymousListener, "wamc", ""},
+		{"10.0.0.1", anonymousListener, "kexp", "ip"},
+		{"10.0.0.2", "app", "wamc", ""},
+		{"10.0.0.3", "app", "kexp", "key"},
+		{"10.0.0.3", anonymousListener, "wamc", "station"},
+		{"10.0.0.3", signedListener, "kexp", ""},
+		{"10.0.0.4", signedListener, "kexp", ""},
+	}
+	var releases []func()
+	for i, lt := range lts {
+		release, err := l.Acquire(lt.ip, lt.listener, lt.station)
+		switch {
+		case lt.limit == "" && err != nil:
+			t.Errorf("stream %d refused: %v", i, err)
+		case lt.limit != "" && (err == nil || err.Limit != lt.limit):
+			t.Errorf("stream %d expected the %s limit, got %v", i, lt.limit, err)
+		case err == nil:
+			releases = append(releases, release)
+		}
+	}
+
+	// released streams make room, once
+	releases[0]()
+	releases[0]()
+	if _, err := l.Acquire("10.0.0.1", anonymousListener, "kexp"); err != nil {
+		t.Errorf("released stream still counted: %v", err)
+	}
+	if _, err := l.Acquire("10.0.0.1", anonymousListener, "kexp"); err == nil {
+		t.Errorf("stream released twice")
+	}
+	for _, release := range releases[1:] {
+		release()
+	}
+	if len(l.keys) != 0 || len(l.stations) != 1 {
+		t.Errorf("released streams not forgotten: %v %v", l.keys, l.stations)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(2, 3)
+	now := time.Date(2017, 7, 30, 3, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("10.0.0.1", now); !ok {
+			t.Errorf("request %d of the burst refused", i)
+		}
+	}
+	ok, wait := l.Allow("10.0.0.1", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("expected a wait of 500ms after the burst, got %v %s", ok, wait)
+	}
+	if ok, _ := l.Allow("10.0.0.2", now); !ok {
+		t.Errorf("other client refused")
+	}
+	if ok, _ := l.Allow("10.0.0.1", now.Add(wait)); !ok {
+		t.Errorf("refilled bucket refused")
+	}
+
+	// full buckets are forgotten
+	l.Allow("10.0.0.3", now.Add(time.Hour))
+	if len(l.buckets) != 1 {
+		t.Errorf("expected 1 bucket after pruning, got %d", len(l.buckets))
+	}
+
+	l = NewRateLimiter(0.1, 1)
+	h := l.Limit(func(*http.Request) string { return "10.0.0.1" },
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	codes := []int{http.StatusOK, http.StatusTooManyRequests}
+	for _, code := range codes {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/preset/list", nil))
+		if rec.Code != code {
+			t.Errorf("expected status %d, got %d", code, rec.Code)
+		}
+		if code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "10" {
+			t.Errorf("expected to retry after 10s, got %q", rec.Header().Get("Retry-After"))
+		}
+	}
+}
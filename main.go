@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/go-kit/kit/log"
@@ -25,32 +28,39 @@ var (
 func configure() *Radio {
 	// Parse flags
 	var (
-		driver        string
-		dbhost        string
-		dbport        int
-		storagedriver string
-		bucketname    string
-		record        bool
-		broadcast     bool
-		addr          string
-		loglevel      string
+		configfile  string
+		printconfig bool
+		migratekeys bool
+		dryrun      bool
 	)
 
-	flag.StringVar(&driver, "driver", "redis", "Database driver: etcd|redis|ssdb|datastore")
-	flag.StringVar(&dbhost, "dbhost", "localhost", "Database host")
-	flag.IntVar(&dbport, "dbport", 6379, "Database port")
-	flag.StringVar(&storagedriver, "storagedriver", "", "Override storage driver: gcs")
-	flag.StringVar(&bucketname, "bucketname", "radiotimemachine", "gcs storage bucket")
-	flag.BoolVar(&record, "record", true, "Record presets")
-	flag.BoolVar(&broadcast, "broadcast", true, "Broadcast to users")
-	flag.StringVar(&addr, "addr", ":8080", "Broadcast address")
-	flag.StringVar(&loglevel, "loglevel", "info", "Logging level: debug|info|warn|error")
+	cfg := DefaultConfig()
+	flagged := cfg.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&configfile, "config", os.Getenv("RTM_CONFIG"), "TOML config file")
+	flag.BoolVar(&printconfig, "print-config", false, "Print the effective config and exit")
+	flag.BoolVar(&migratekeys, "migratekeys", false, "Rewrite stored chunk keys in canonical UTC form and exit")
+	flag.BoolVar(&dryrun, "dryrun", false, "Report what -migratekeys would rewrite without changing anything")
 
 	flag.Parse()
 
-	// Initialize logging
+	// Load the config over the defaults
 	logger = log.NewLogfmtLogger(os.Stdout)
-	switch loglevel {
+	if err := cfg.Load(configfile, os.LookupEnv, flagged); err != nil {
+		for _, err := range err.(ConfigErrors) {
+			level.Error(logger).Log(
+				"msg", "Invalid config",
+				"err", err)
+		}
+		os.Exit(1)
+	}
+
+	if printconfig {
+		cfg.WriteTOML(os.Stdout)
+		os.Exit(0)
+	}
+
+	// Initialize logging
+	switch cfg.LogLevel {
 	case "debug":
 		logger = level.NewFilter(logger, level.AllowDebug())
 	case "info":
@@ -59,74 +69,201 @@ func configure() *Radio {
 		logger = level.NewFilter(logger, level.AllowWarn())
 	case "error":
 		logger = level.NewFilter(logger, level.AllowError())
-	default:
-		level.Error(logger).Log("msg", fmt.Sprintf("No %q loglevel found", loglevel))
-		os.Exit(1)
 	}
 	logger = log.With(logger, "caller", log.DefaultCaller)
 	logger.Log(
 		"msg", "Logging initialized",
-		"level", loglevel)
-
-	// Initialize the backend
-	var backend Backend
-	switch driver {
-	case "etcd":
-		backend = &EtcdBackend{host: dbhost, port: dbport}
-	case "redis":
-		backend = &RedisBackend{host: dbhost, port: dbport}
-	case "ssdb":
-		backend = &RedisBackend{ssdb: true, host: dbhost, port: dbport}
-	case "datastore":
-		backend = &DatastoreBackend{}
-	default:
-		level.Error(logger).Log("msg", fmt.Sprintf("No %q driver found", driver))
+		"level", cfg.LogLevel)
+
+	if err := ConfigureTracing(cfg.TraceExporter, cfg.TraceSample); err != nil {
+		level.Error(logger).Log(
+			"msg", "Cannot configure tracing",
+			"err", err)
 		os.Exit(1)
 	}
 
-	if err := backend.Init(); err != nil {
+	// Initialize the backend. The config has been checked to
+	// give drivers that hold presets and record tapes
+	backend, err := OpenDriver(cfg.Driver, cfg)
+	if err != nil {
 		level.Error(logger).Log(
-			"msg", fmt.Sprintf("Cannot init backend with driver %s", driver),
+			"msg", fmt.Sprintf("Cannot init backend with driver %s", cfg.Driver),
 			"err", err)
 		os.Exit(1)
 	}
 	level.Info(logger).Log(
 		"msg", "Backend initialized",
-		"driver", driver,
-		"dbaddr", fmt.Sprintf("%s:%d", dbhost, dbport))
-
-	// Use separate storage driver
-	var storageBackend Backend = backend
-	if storagedriver == "gcs" {
-		// GOOGLE_CLOUD_PROJECT env var needed if not in GCE
-		gcs := &GCSBackend{bucket: bucketname}
-		if err := gcs.Init(); err != nil {
+		"driver", cfg.Driver,
+		"dbaddr", fmt.Sprintf("%s:%d", cfg.DBHost, cfg.DBPort))
+
+	// Open the storage driver and any other mirrors, sharing
+	// the database's backend when it records tapes too
+	opened := map[string]Backend{cfg.Driver: backend}
+	recorder := func(driver string, b Backend) TapeBackend {
+		t, ok := b.(TapeBackend)
+		if !ok {
+			level.Error(logger).Log(
+				"msg", fmt.Sprintf("Backend with driver %s cannot record tapes", driver))
+			os.Exit(1)
+		}
+		return t
+	}
+	openStorage := func(driver string) TapeBackend {
+		if b, ok := opened[driver]; ok {
+			return recorder(driver, b)
+		}
+		b, err := OpenDriver(driver, cfg)
+		if err != nil {
 			level.Error(logger).Log(
-				"msg", "Cannot init GCS backend",
+				"msg", fmt.Sprintf("Cannot init storage backend with driver %s", driver),
 				"err", err)
 			os.Exit(1)
 		}
 		level.Info(logger).Log(
 			"msg", "Storage backend initialized",
-			"driver", "gcs")
-		storageBackend = gcs
+			"driver", driver)
+		opened[driver] = b
+		return recorder(driver, b)
+	}
+
+	var tapes TapeBackend
+	storageDriver := cfg.Driver
+	switch {
+	case len(cfg.Mirrors) > 0:
+		mirror := NewMirrorTapeBackend(cfg.MirrorQuorum, cfg.MirrorBudget)
+		for _, driver := range cfg.Mirrors {
+			mirror.Mirror(driver, openStorage(driver))
+		}
+		if err := mirror.Init(); err != nil {
+			level.Error(logger).Log(
+				"msg", "Cannot init mirrored storage",
+				"err", err)
+			os.Exit(1)
+		}
+		tapes = mirror
+		storageDriver = strings.Join(cfg.Mirrors, ",")
+		level.Info(logger).Log(
+			"msg", "Mirrored storage initialized",
+			"mirrors", storageDriver,
+			"quorum", cfg.MirrorQuorum)
+	case cfg.StorageDriver == "":
+		tapes = recorder(cfg.Driver, backend)
+	default:
+		tapes = openStorage(cfg.StorageDriver)
+		storageDriver = cfg.StorageDriver
+
+		if cfg.TierAfter > 0 {
+			tapes = NewTieredTapeBackend(recorder(cfg.Driver, backend), tapes, cfg.TierAfter, cfg.TierInterval)
+			storageDriver = cfg.Driver + "+" + cfg.StorageDriver
+			level.Info(logger).Log(
+				"msg", "Tiered storage initialized",
+				"hot", cfg.Driver,
+				"cold", cfg.StorageDriver,
+				"after", cfg.TierAfter)
+		}
+	}
+
+	if migratekeys {
+		migrateKeys(tapes, dryrun)
+		os.Exit(0)
+	}
+
+	// Load the geoip database. Client addresses are found
+	// through trusted proxies even without one
+	trusted, _ := ParseCIDRs(strings.Join(cfg.TrustedProxies, ","))
+	locator := &Locator{TrustedProxies: trusted}
+	if cfg.GeoIPDB != "" {
+		db, err := OpenGeoIPDB(cfg.GeoIPDB)
+		if err != nil {
+			level.Error(logger).Log(
+				"msg", "Cannot open geoip database",
+				"err", err)
+			os.Exit(1)
+		}
+		locator.DB = db
+		level.Info(logger).Log(
+			"msg", "GeoIP database loaded",
+			"path", cfg.GeoIPDB)
+	}
+
+	var auth *ListenerAuth
+	if cfg.AuthRequired || cfg.AuthAPIKeys || cfg.AuthSigningKey != "" {
+		auth = &ListenerAuth{Required: cfg.AuthRequired}
+		if cfg.AuthAPIKeys {
+			keys, ok := backend.(KeyBackend)
+			if !ok {
+				level.Error(logger).Log(
+					"msg", fmt.Sprintf("Backend with driver %s cannot hold api keys", cfg.Driver))
+				os.Exit(1)
+			}
+			auth.Keys = keys
+		}
+		if cfg.AuthSigningKey != "" {
+			auth.Secret = []byte(cfg.AuthSigningKey)
+		}
+	}
+
+	var streams *StreamLimiter
+	if cfg.StreamsPerIP > 0 || cfg.StreamsPerKey > 0 || cfg.StationListeners > 0 {
+		streams = NewStreamLimiter(cfg.StreamsPerIP, cfg.StreamsPerKey, cfg.StationListeners)
+	}
+	var presetLimit *RateLimiter
+	if cfg.PresetRate > 0 {
+		presetLimit = NewRateLimiter(cfg.PresetRate, cfg.PresetBurst)
+	}
+
+	presets, ok := backend.(PresetBackend)
+	if !ok {
+		level.Error(logger).Log(
+			"msg", fmt.Sprintf("Backend with driver %s cannot hold presets", cfg.Driver))
+		os.Exit(1)
+	}
+
+	// the config has been checked to give a valid policy
+	dst, _ := ParseDSTPolicy(cfg.DSTRepeated, cfg.DSTSkipped)
+
+	var closers []io.Closer
+	for _, b := range opened {
+		if c, ok := b.(io.Closer); ok {
+			closers = append(closers, c)
+		}
+	}
+
+	var admin *http.Server
+	if cfg.AdminAddr != "" {
+		admin = &http.Server{Addr: cfg.AdminAddr}
 	}
 
 	// Construct the radio
 	return &Radio{
-		Server: &http.Server{Addr: addr},
+		Server: &http.Server{Addr: cfg.Addr},
+		Admin:  admin,
 		TapeDeck: &TapeDeck{
-			backend: storageBackend.(TapeBackend),
+			backend: tapes,
+			driver:  storageDriver,
 		},
 		Presets: &Presets{
-			backend: backend.(PresetBackend),
+			backend: presets,
 		},
 		Options: RadioOptions{
-			Broadcast: broadcast,
-			Record:    record,
+			Broadcast:     cfg.Broadcast,
+			Record:        cfg.Record,
+			BufferChunks:  cfg.BufferChunks,
+			DST:           dst,
+			SweepInterval: cfg.SweepInterval,
+			PresetPoll:    cfg.PresetPoll,
+			CORSOrigins:   cfg.CORSOrigins,
+			ReadyChunkAge: cfg.ReadyChunkAge,
 		},
-		PathBroadcast: "/listen/",
-		PathPreset:    "/preset/",
+		Locator:       locator,
+		Auth:          auth,
+		Streams:       streams,
+		PresetLimit:   presetLimit,
+		PathBroadcast: cfg.PathBroadcast,
+		PathPreset:    cfg.PathPreset,
+		PathTapes:     cfg.PathTapes,
+		AdminToken:    cfg.AdminToken,
+		Closers:       closers,
 		//RecordingEngineer: RecordingEngineer{
 		//	ch: make(chan StatusMessage, 1),
 		//	s:  make(map[string]Status),
@@ -134,7 +271,37 @@ func configure() *Radio {
 	}
 }
 
+// Rewrite chunk keys in the storage backend
+func migrateKeys(backend TapeBackend, dryrun bool) {
+	m, ok := backend.(KeyMigrator)
+	if !ok {
+		level.Error(logger).Log("msg", "Storage backend cannot migrate keys")
+		os.Exit(1)
+	}
+
+	n, collided, err := m.MigrateKeys(context.Background(), dryrun)
+	if err != nil {
+		level.Error(logger).Log(
+			"msg", "Key migration failed",
+			"migrated", n,
+			"collided", collided,
+			"err", err)
+		os.Exit(1)
+	}
+	level.Info(logger).Log(
+		"msg", "Key migration complete",
+		"migrated", n,
+		"collided", collided,
+		"dryrun", dryrun)
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
 	radio := configure()
 	radio.On()
 
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics exposed in the prometheus text format
+var (
+	metricRecordedBytes = NewCounter("rtm_recorded_bytes_total",
+		"Bytes recorded from each station", "station")
+	metricChunksWritten = NewCounter("rtm_chunks_written_total",
+		"Chunks written for each station, synthetic chunks fill gaps", "station", "synthetic")
+	metricWriteErrors = NewCounter("rtm_chunk_write_errors_total",
+		"Errors writing chunks for each station", "station")
+	metricReconnects = NewCounter("rtm_reconnects_total",
+		"Reconnections to each station after its stream dropped", "station")
+	metricLastChunk = NewGauge("rtm_last_chunk_timestamp_seconds",
+		"Unix time of the last chunk written for each station", "station")
+	metricDrift = NewGauge("rtm_recording_drift_seconds",
+		"How far each station's chunk keys trail the time chunks arrive", "station")
+	metricListeners = NewGauge("rtm_listeners",
+		"Listeners streaming each station", "station")
+	metricStreamErrors = NewCounter("rtm_stream_errors_total",
+		"Broadcasts to listeners ended by an error, by kind", "station", "kind")
+	metricChecksumFailures = NewCounter("rtm_chunk_checksum_failures_total",
+		"Chunks read for each station that didn't match their checksum", "station")
+	metricChunksMoved = NewCounter("rtm_chunks_moved_total",
+		"Chunks moved from the hot tier to the cold tier for each station", "station")
+	metricMirrorErrors = NewCounter("rtm_mirror_write_errors_total",
+		"Chunks each tape mirror failed to write", "mirror")
+	metricChunksSwept = NewCounter("rtm_chunks_swept_total",
+		"Expired chunks deleted from storage for each station", "station")
+	metricListenerStreams = NewCounter("rtm_listener_streams_total",
+		"Streams started for each station by each api key, by signed urls or anonymously", "station", "listener")
+	metricAuthRejections = NewCounter("rtm_listener_auth_rejections_total",
+		"Listeners refused a stream for each kind of auth failure", "kind")
+	metricLimited = NewCounter("rtm_limited_requests_total",
+		"Requests refused for going over each limit", "limit")
+	metricChunkRead = NewHistogram("rtm_chunk_read_seconds",
+		"Time taken to read a chunk from each storage backend",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "backend")
+)
+
+var registry = &Registry{}
+
+// A Registry serves the metrics registered with it
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*Metric
+}
+
+// Register adds metrics to the registry
+func (r *Registry) Register(ms ...*Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, ms...)
+}
+
+// ServeHTTP writes all registered metrics
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	ms := append([]*Metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, m := range ms {
+		m.write(&buf)
+	}
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	buf.WriteTo(rw)
+}
+
+// A Metric is a family of counters, gauges or histograms
+// sharing a name and label names
+type Metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64
+	counts []uint64 // histogram bucket counts
+	count  uint64
+}
+
+// NewCounter registers a counter
+func NewCounter(name, help string, labels ...string) *Metric {
+	return newMetric(name, help, "counter", nil, labels)
+}
+
+// NewGauge registers a gauge
+func NewGauge(name, help string, labels ...string) *Metric {
+	return newMetric(name, help, "gauge", nil, labels)
+}
+
+// NewHistogram registers a histogram with the given upper bounds
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Metric {
+	return newMetric(name, help, "histogram", buckets, labels)
+}
+
+func newMetric(name, help, kind string, buckets []float64, labels []string) *Metric {
+	m := &Metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	registry.Register(m)
+	return m
+}
+
+func (m *Metric) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d", m.name, len(m.labels), len(values)))
+	}
+	k := strings.Join(values, "\xff")
+	s, ok := m.series[k]
+	if !ok {
+		s = &series{labels: append([]string{}, values...)}
+		if m.kind == "histogram" {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[k] = s
+	}
+	return s
+}
+
+// Add adds v to the series with the label values
+func (m *Metric) Add(v float64, values ...string) {
+	m.mu.Lock()
+	m.get(values).value += v
+	m.mu.Unlock()
+}
+
+// Set sets the series with the label values to v
+func (m *Metric) Set(v float64, values ...string) {
+	m.mu.Lock()
+	m.get(values).value = v
+	m.mu.Unlock()
+}
+
+// Delete forgets the series with the label values
+func (m *Metric) Delete(values ...string) {
+	m.mu.Lock()
+	delete(m.series, strings.Join(values, "\xff"))
+	m.mu.Unlock()
+}
+
+// Observe records v in the histogram series with the label values
+func (m *Metric) Observe(v float64, values ...string) {
+	m.mu.Lock()
+	s := m.get(values)
+	for i, b := range m.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+	m.mu.Unlock()
+}
+
+// Max returns the largest value of the series whose label values
+// keep accepts, if there are any. A nil keep accepts every series
+func (m *Metric) Max(keep func(values []string) bool) (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	max, ok := math.Inf(-1), false
+	for _, s := range m.series {
+		if keep == nil || keep(s.labels) {
+			max, ok = math.Max(max, s.value), true
+		}
+	}
+	return max, ok
+}
+
+// Value returns the value of the series with the label values
+func (m *Metric) Value(values ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.get(values).value
+}
+
+func (m *Metric) write(buf *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			fmt.Fprintf(buf, "%s%s %s\n", m.name, m.labelPairs(s.labels, "", ""), formatFloat(s.value))
+			continue
+		}
+		for i, b := range m.buckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", m.name, m.labelPairs(s.labels, "le", formatFloat(b)), s.counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", m.name, m.labelPairs(s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", m.name, m.labelPairs(s.labels, "", ""), formatFloat(s.value))
+		fmt.Fprintf(buf, "%s_count%s %d\n", m.name, m.labelPairs(s.labels, "", ""), s.count)
+	}
+}
+
+func (m *Metric) labelPairs(values []string, extra, extraValue string) string {
+	var pairs []string
+	for i, l := range m.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l, labelEscaper.Replace(values[i])))
+	}
+	if extra != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	c := NewCounter("test_chunks_total", "Chunks", "station")
+	c.Add(2, "wkrp")
+	c.Add(1, "wkrp")
+	c.Add(1, `w"krp`)
+
+	h := NewHistogram("test_read_seconds", "Reads", []float64{.1, 1}, "backend")
+	h.Observe(.05, "redis")
+	h.Observe(.5, "redis")
+
+	if v := c.Value("wkrp"); v != 3 {
+		t.Errorf("counter value wrong. expected 3, got %v", v)
+	}
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, line := range []string{
+		"# TYPE test_chunks_total counter",
+		`test_chunks_total{station="wkrp"} 3`,
+		`test_chunks_total{station="w\"krp"} 1`,
+		"# TYPE test_read_seconds histogram",
+		`test_read_seconds_bucket{backend="redis",le="0.1"} 1`,
+		`test_read_seconds_bucket{backend="redis",le="1"} 2`,
+		`test_read_seconds_bucket{backend="redis",le="+Inf"} 2`,
+		`test_read_seconds_sum{backend="redis"} 0.55`,
+		`test_read_seconds_count{backend="redis"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics missing line %s", line)
+		}
+	}
+
+	c.Delete("wkrp")
+	if max, _ := c.Max(nil); max != 1 {
+		t.Errorf("deleted series still counted, max %v", max)
+	}
+}
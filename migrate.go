@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// MigrateProgressChunks is how often chunk copies are logged
+const MigrateProgressChunks = 100
+
+// commands run instead of the radio when named as the first argument
+var commands = map[string]func(args []string) int{
+	"migrate": migrateCommand,
+	"dump":    dumpCommand,
+	"restore": restoreCommand,
+}
+
+// CopyPresets writes every preset in from to to, overwriting
+// presets of the same name, and returns how many were copied
+func CopyPresets(from, to PresetBackend, dryrun bool) (int, error) {
+	n := 0
+	cursor := ""
+	for {
+		data, next, err := from.ListPresets(cursor, presetPageSize)
+		if err != nil {
+			return n, err
+		}
+		for _, d := range data {
+			var s Station
+			if err := json.Unmarshal(d, &s); err != nil {
+				return n, fmt.Errorf("bad preset: %v", err)
+			}
+			if !dryrun {
+				if err := to.WritePreset(s.Name, d); err != nil {
+					return n, err
+				}
+			}
+			n++
+		}
+		if next == "" {
+			return n, nil
+		}
+		cursor = next
+	}
+}
+
+// CopyChunks copies a station's chunks recorded from from until to
+// that aren't already in the destination, so an interrupted copy
+// resumes where it stopped. It reports progress as chunks are copied
+func CopyChunks(ctx context.Context, src, dst TapeBackend, name string, from, to time.Time, dryrun bool, progress func(copied, total int)) (int, error) {
+	chunks, err := src.ListChunks(ctx, name, from, to)
+	if err != nil {
+		return 0, err
+	}
+	existing, err := dst.ListChunks(ctx, name, from, to)
+	if err != nil {
+		return 0, err
+	}
+	copied := map[int64]bool{}
+	for _, t := range existing {
+		copied[t.Unix()] = true
+	}
+
+	var missing []time.Time
+	for _, t := range chunks {
+		if !copied[t.Unix()] {
+			missing = append(missing, t)
+		}
+	}
+
+	for n, t := range missing {
+		if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+		if !dryrun {
+			if err := CopyChunk(ctx, src, dst, name, t); err != nil {
+				return n, fmt.Errorf("chunk %s: %v", t.UTC().Format(time.RFC3339), err)
+			}
+		}
+		if progress != nil && (n+1)%MigrateProgressChunks == 0 {
+			progress(n+1, len(missing))
+		}
+	}
+	return len(missing), nil
+}
+
+// commandLogger logs for a command without the radio's config
+func commandLogger() log.Logger {
+	return log.With(log.NewLogfmtLogger(os.Stdout), "caller", log.DefaultCaller)
+}
+
+// migrateCommand copies presets and recorded tapes between backends
+func migrateCommand(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", "", "Backend url to copy from, like redis://host:6379/0 or gcs://bucket")
+	to := fs.String("to", "", "Backend url to copy to")
+	stations := fs.String("stations", "", "Comma separated stations whose tapes to copy, instead of every preset")
+	presets := fs.Bool("presets", true, "Copy presets")
+	tapes := fs.Bool("tapes", true, "Copy recorded tapes")
+	dryrun := fs.Bool("dryrun", false, "Report what would be copied without copying anything")
+	fs.Parse(args)
+
+	logger = commandLogger()
+	if *from == "" || *to == "" {
+		level.Error(logger).Log("msg", "migrate needs -from and -to backend urls")
+		return 2
+	}
+
+	src, srcDriver, err := BackendFromURL(*from)
+	if err != nil {
+		level.Error(logger).Log("msg", "Cannot open source backend", "err", err)
+		return 1
+	}
+	dst, dstDriver, err := BackendFromURL(*to)
+	if err != nil {
+		level.Error(logger).Log("msg", "Cannot open destination backend", "err", err)
+		return 1
+	}
+	level.Info(logger).Log(
+		"msg", "Migrating",
+		"from", srcDriver.Name,
+		"to", dstDriver.Name,
+		"dryrun", *dryrun)
+
+	var srcPresets, dstPresets PresetBackend
+	if p, ok := src.(PresetBackend); ok && srcDriver.Has(CapPresets) {
+		srcPresets = p
+	}
+	if p, ok := dst.(PresetBackend); ok && dstDriver.Has(CapPresets) {
+		dstPresets = p
+	}
+	if *presets && srcPresets != nil && dstPresets != nil {
+		n, err := CopyPresets(srcPresets, dstPresets, *dryrun)
+		if err != nil {
+			level.Error(logger).Log("msg", "Preset copy failed", "copied", n, "err", err)
+			return 1
+		}
+		level.Info(logger).Log("msg", "Presets copied", "copied", n, "dryrun", *dryrun)
+	} else if *presets {
+		level.Info(logger).Log("msg", "Skipping presets, both backends must hold presets")
+	}
+
+	if !*tapes {
+		return 0
+	}
+	srcTapes, srcOK := src.(TapeBackend)
+	dstTapes, dstOK := dst.(TapeBackend)
+	if !srcOK || !dstOK || !srcDriver.Has(CapTapes) || !dstDriver.Has(CapTapes) {
+		level.Info(logger).Log("msg", "Skipping tapes, both backends must hold tapes")
+		return 0
+	}
+
+	names, err := stationNames(*stations, srcPresets, dstPresets)
+	if err != nil {
+		level.Error(logger).Log("msg", "Cannot find stations to copy", "err", err)
+		return 1
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	total := 0
+	for _, name := range names {
+		name := name
+		n, err := CopyChunks(ctx, srcTapes, dstTapes, name, now.Add(-TTL), now, *dryrun, func(copied, total int) {
+			level.Info(logger).Log(
+				"msg", "Copying chunks",
+				"station", name,
+				"copied", copied,
+				"total", total)
+		})
+		total += n
+		if err != nil {
+			level.Error(logger).Log(
+				"msg", "Chunk copy failed, rerun to resume",
+				"station", name,
+				"copied", n,
+				"err", err)
+			return 1
+		}
+		level.Info(logger).Log(
+			"msg", "Station copied",
+			"station", name,
+			"chunks", n,
+			"dryrun", *dryrun)
+	}
+	level.Info(logger).Log(
+		"msg", "Migration complete",
+		"stations", len(names),
+		"chunks", total,
+		"dryrun", *dryrun)
+	return 0
+}
+
+// stationNames returns the listed stations, or else every
+// preset in the first of the preset backends there is
+func stationNames(list string, backends ...PresetBackend) ([]string, error) {
+	if list != "" {
+		return strings.Split(list, ","), nil
+	}
+	for _, b := range backends {
+		if b == nil {
+			continue
+		}
+		var names []string
+		data, err := b.ReadAllPresets()
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range data {
+			var s Station
+			if err := json.Unmarshal(d, &s); err != nil {
+				return nil, fmt.Errorf("bad preset: %v", err)
+			}
+			names = append(names, s.Name)
+		}
+		return names, nil
+	}
+	return nil, fmt.Errorf("no presets to find stations in, list them with -stations")
+}
+
+// DumpPresets writes every preset as a json array
+func DumpPresets(b PresetBackend, w io.Writer) (int, error) {
+	data, err := b.ReadAllPresets()
+	if err != nil {
+		return 0, err
+	}
+	presets := make([]json.RawMessage, len(data))
+	for i, d := range data {
+		presets[i] = d
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return len(presets), enc.Encode(presets)
+}
+
+// RestorePresets writes the presets in a json array from DumpPresets
+func RestorePresets(b PresetBackend, r io.Reader, dryrun bool) (int, error) {
+	var presets []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&presets); err != nil {
+		return 0, err
+	}
+	for n, d := range presets {
+		var s Station
+		if err := json.Unmarshal(d, &s); err != nil || s.Name == "" {
+			return n, fmt.Errorf("bad preset %d: %s", n, d)
+		}
+		if dryrun {
+			continue
+		}
+		if err := b.WritePreset(s.Name, d); err != nil {
+			return n, err
+		}
+	}
+	return len(presets), nil
+}
+
+// presetBackendFromURL opens a backend that must hold presets
+func presetBackendFromURL(raw string) (PresetBackend, error) {
+	backend, driver, err := BackendFromURL(raw)
+	if err != nil {
+		return nil, err
+	}
+	presets, ok := backend.(PresetBackend)
+	if !ok || !driver.Has(CapPresets) {
+		return nil, fmt.Errorf("the %s driver cannot hold presets", driver.Name)
+	}
+	return presets, nil
+}
+
+// dumpCommand writes the presets in a backend to a json file
+func dumpCommand(args []string) int {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	from := fs.String("from", "", "Backend url to dump presets from")
+	file := fs.String("file", "-", "File to write the presets to, - for stdout")
+	fs.Parse(args)
+
+	logger = commandLogger()
+	b, err := presetBackendFromURL(*from)
+	if err != nil {
+		level.Error(logger).Log("msg", "Cannot open backend", "err", err)
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if *file != "-" {
+		f, err := os.Create(*file)
+		if err != nil {
+			level.Error(logger).Log("msg", "Cannot create dump", "err", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	n, err := DumpPresets(b, w)
+	if err != nil {
+		level.Error(logger).Log("msg", "Dump failed", "err", err)
+		return 1
+	}
+	if *file != "-" {
+		level.Info(logger).Log("msg", "Presets dumped", "presets", n, "file", *file)
+	}
+	return 0
+}
+
+// restoreCommand writes the presets in a json file to a backend
+func restoreCommand(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	to := fs.String("to", "", "Backend url to restore presets to")
+	file := fs.String("file", "-", "File to read the presets from, - for stdin")
+	dryrun := fs.Bool("dryrun", false, "Check the presets without writing them")
+	fs.Parse(args)
+
+	logger = commandLogger()
+	b, err := presetBackendFromURL(*to)
+	if err != nil {
+		level.Error(logger).Log("msg", "Cannot open backend", "err", err)
+		return 1
+	}
+
+	var r io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			level.Error(logger).Log("msg", "Cannot open dump", "err", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+
+	n, err := RestorePresets(b, r, *dryrun)
+	if err != nil {
+		level.Error(logger).Log("msg", "Restore failed", "restored", n, "err", err)
+		return 1
+	}
+	level.Info(logger).Log("msg", "Presets restored", "presets", n, "dryrun", *dryrun)
+	return 0
+}
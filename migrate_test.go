@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+)
+
+func TestBackendFromURL(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis failed: %v", err)
+	}
+	defer s.Close()
+
+	backend, driver, err := BackendFromURL("redis://" + s.Addr() + "/2")
+	if err != nil || driver.Name != "redis" {
+		t.Fatalf("BackendFromURL() = %v, %v", driver, err)
+	}
+	if b := backend.(*RedisBackend); b.db != 2 || b.ssdb {
+		t.Errorf("BackendFromURL() configured %+v", b)
+	}
+
+	for _, u := range []string{"mongodb://localhost", "redis://" + s.Addr() + "/two", "redis://localhost:port"} {
+		if _, _, err := BackendFromURL(u); err == nil {
+			t.Errorf("BackendFromURL(%q) succeeded", u)
+		}
+	}
+}
+
+func TestDriverCheck(t *testing.T) {
+	backends := map[string]Backend{
+		"datastore": &DatastoreBackend{},
+		"etcd":      &EtcdBackend{},
+		"firestore": &FirestoreBackend{},
+		"gcs":       &GCSBackend{},
+		"redis":     &RedisBackend{},
+	}
+	for name, b := range backends {
+		d, ok := LookupDriver(name)
+		if !ok {
+			t.Fatalf("LookupDriver(%q) failed", name)
+		}
+		if err := d.check(b); err != nil {
+			t.Errorf("%s check() failed: %v", name, err)
+		}
+	}
+
+	for _, c := range []Capability{CapPresets, CapWatch, CapKeys} {
+		d := &Driver{Name: "fake", Capabilities: c}
+		if err := d.check(&GCSBackend{}); err == nil {
+			t.Errorf("check() of %s passed a gcs backend", c)
+		}
+	}
+	// tapes that don't expire must be swept
+	d := &Driver{Name: "fake", Capabilities: CapTapes}
+	if err := d.check(&EtcdBackend{}); err == nil || !strings.Contains(err.Error(), "Sweeper") {
+		t.Errorf("check() = %v, want Sweeper error", err)
+	}
+}
+
+func TestCopyPresets(t *testing.T) {
+	from := &testPresetBackend{data: map[string][]byte{
+		"wamc": []byte(`{"name":"wamc","url":"http://wamc","location":"America/New_York"}`),
+		"wkrp": []byte(`{"name":"wkrp","url":"http://wkrp","location":"America/New_York"}`),
+	}}
+	to := &testPresetBackend{data: map[string][]byte{}}
+
+	if n, err := CopyPresets(from, to, true); err != nil || n != 2 || len(to.data) != 0 {
+		t.Errorf("CopyPresets() dry run = %d, %v, wrote %d", n, err, len(to.data))
+	}
+	if n, err := CopyPresets(from, to, false); err != nil || n != 2 || !bytes.Equal(to.data["wkrp"], from.data["wkrp"]) {
+		t.Errorf("CopyPresets() = %d, %v, wrote %v", n, err, to.data)
+	}
+
+	var dump bytes.Buffer
+	if n, err := DumpPresets(from, &dump); err != nil || n != 2 {
+		t.Fatalf("DumpPresets() = %d, %v", n, err)
+	}
+	restored := &testPresetBackend{data: map[string][]byte{}}
+	if n, err := RestorePresets(restored, &dump, false); err != nil || n != 2 || len(restored.data) != 2 {
+		t.Errorf("RestorePresets() = %d, %v, wrote %v", n, err, restored.data)
+	}
+	if _, err := RestorePresets(restored, bytes.NewBufferString(`[{"url":"http://nameless"}]`), false); err == nil {
+		t.Errorf("RestorePresets() accepted a preset without a name")
+	}
+}
+
+func TestCopyChunks(t *testing.T) {
+	src, dst := newMemTapeBackend(), newMemTapeBackend()
+	ctx := context.Background()
+	cue := time.Date(2017, 7, 30, 10, 0, 0, 0, time.UTC)
+
+	blank, _ := src.BlankTape(ctx, "wamc", Incrementer{cue})
+	for i := 0; i < 5; i++ {
+		blank.Write(data)
+	}
+	// an earlier copy was interrupted after two chunks
+	for _, c := range []time.Time{cue, cue.Add(20 * time.Second)} {
+		if err := CopyChunk(ctx, src, dst, "wamc", c); err != nil {
+			t.Fatalf("CopyChunk() failed: %v", err)
+		}
+	}
+
+	from, to := cue, cue.Add(time.Hour)
+	if n, err := CopyChunks(ctx, src, dst, "wamc", from, to, true, nil); err != nil || n != 3 || len(dst.chunks) != 2 {
+		t.Errorf("CopyChunks() dry run = %d, %v, wrote %d", n, err, len(dst.chunks)-2)
+	}
+	if n, err := CopyChunks(ctx, src, dst, "wamc", from, to, false, nil); err != nil || n != 3 || len(dst.chunks) != 5 {
+		t.Errorf("CopyChunks() = %d, %v, have %d", n, err, len(dst.chunks))
+	}
+	if m := dst.meta["wamc/2017-07-30T10:01:20Z"]; m.Length != len(data) {
+		t.Errorf("chunk metadata not copied: %+v", m)
+	}
+	if n, err := CopyChunks(ctx, src, dst, "wamc", from, to, false, nil); err != nil || n != 0 {
+		t.Errorf("CopyChunks() again = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MirrorBudgetWindow is how long a mirror's write failures count
+// against its error budget
+const MirrorBudgetWindow = time.Minute
+
+// A MirrorTapeBackend writes every chunk to each of its mirrors, and
+// plays chunks from the first healthy mirror that has them. Writes
+// succeed once a quorum of mirrors have written the chunk, and a
+// mirror that spends its error budget is skipped until it recovers
+type MirrorTapeBackend struct {
+	mirrors []*mirror
+	quorum  int
+	budget  int
+
+	// pending counts writes still running after their chunk's quorum
+	pending sync.WaitGroup
+}
+
+// A mirror is a backend and the write failures counting against it
+type mirror struct {
+	name    string
+	backend TapeBackend
+
+	mu       sync.Mutex
+	failures []time.Time
+}
+
+// NewMirrorTapeBackend needs quorum mirrors to write each chunk, and
+// skips mirrors that fail budget writes within the window
+func NewMirrorTapeBackend(quorum, budget int) *MirrorTapeBackend {
+	return &MirrorTapeBackend{quorum: quorum, budget: budget}
+}
+
+// Mirror adds a backend. Chunks are played from the first
+// healthy backend added
+func (b *MirrorTapeBackend) Mirror(name string, backend TapeBackend) {
+	b.mirrors = append(b.mirrors, &mirror{name: name, backend: backend})
+}
+
+// fail counts a write failure against the mirror's budget
+func (m *mirror) fail(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures = append(m.failures, now)
+}
+
+// spent reports whether the mirror failed budget writes within the window
+func (m *mirror) spent(now time.Time, budget int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := 0
+	for i < len(m.failures) && now.Sub(m.failures[i]) > MirrorBudgetWindow {
+		i++
+	}
+	m.failures = m.failures[i:]
+	return len(m.failures) >= budget
+}
+
+// healthy returns the mirrors within their error budget, or
+// every mirror if that leaves too few for a quorum
+func (b *MirrorTapeBackend) healthy(now time.Time) []*mirror {
+	var ms []*mirror
+	for _, m := range b.mirrors {
+		if !m.spent(now, b.budget) {
+			ms = append(ms, m)
+		}
+	}
+	if len(ms) < b.quorum {
+		return b.mirrors
+	}
+	return ms
+}
+
+// Implements Backend, the mirrors are initialized on their own
+func (b *MirrorTapeBackend) Init() error {
+	if len(b.mirrors) < b.quorum {
+		return fmt.Errorf("a quorum of %d is more than the %d mirrors", b.quorum, len(b.mirrors))
+	}
+	return nil
+}
+
+// Implements Pinger, a quorum of mirrors must be reachable
+func (b *MirrorTapeBackend) Ping(ctx context.Context) error {
+	ok := 0
+	var err error
+	for _, m := range b.mirrors {
+		if e := ping(ctx, m.backend); e != nil {
+			err = fmt.Errorf("mirror %s: %v", m.name, e)
+			continue
+		}
+		ok++
+	}
+	if ok < b.quorum {
+		return err
+	}
+	return nil
+}
+
+// Implements BlankTape
+func (b *MirrorTapeBackend) BlankTape(ctx context.Context, name string, i Incrementer) (*BlankTape, error) {
+	return &BlankTape{tape: &MirrorTape{name: name, i: i, b: b}}, nil
+}
+
+// Implements RecordedTape
+func (b *MirrorTapeBackend) RecordedTape(ctx context.Context, name string, i Incrementer) (*RecordedTape, error) {
+	return &RecordedTape{tape: &MirrorTape{name: name, i: i, b: b}}, nil
+}
+
+// Implements TapeBackend, listing the chunks on any mirror
+func (b *MirrorTapeBackend) ListChunks(ctx context.Context, name string, from, to time.Time) ([]time.Time, error) {
+	seen := map[int64]bool{}
+	var (
+		chunks []time.Time
+		err    error
+		listed bool
+	)
+	for _, m := range b.healthy(time.Now()) {
+		cs, e := m.backend.ListChunks(ctx, name, from, to)
+		if e != nil {
+			err = fmt.Errorf("mirror %s: %v", m.name, e)
+			continue
+		}
+		listed = true
+		for _, t := range cs {
+			if !seen[t.Unix()] {
+				seen[t.Unix()] = true
+				chunks = append(chunks, t)
+			}
+		}
+	}
+	if !listed {
+		return nil, err
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Before(chunks[j]) })
+	return chunks, nil
+}
+
+// Implements KeyMigrator
+func (b *MirrorTapeBackend) MigrateKeys(ctx context.Context, dryrun bool) (n, collided int, err error) {
+	for _, m := range b.mirrors {
+		km, ok := m.backend.(KeyMigrator)
+		if !ok {
+			continue
+		}
+		migrated, c, err := km.MigrateKeys(ctx, dryrun)
+		n, collided = n+migrated, collided+c
+		if err != nil {
+			return n, collided, fmt.Errorf("mirror %s: %v", m.name, err)
+		}
+	}
+	return n, collided, nil
+}
+
+// Implements Sweeper
+func (b *MirrorTapeBackend) Sweep(ctx context.Context, now time.Time) (int, error) {
+	n := 0
+	for _, m := range b.mirrors {
+		s, ok := m.backend.(Sweeper)
+		if !ok {
+			continue
+		}
+		swept, err := s.Sweep(ctx, now)
+		n += swept
+		if err != nil {
+			return n, fmt.Errorf("mirror %s: %v", m.name, err)
+		}
+	}
+	return n, nil
+}
+
+// A MirrorTape writes each chunk to the healthy mirrors,
+// and plays each chunk from the first that has it
+type MirrorTape struct {
+	name string
+	i    Incrementer
+	b    *MirrorTapeBackend
+}
+
+// Write returns once a quorum of mirrors has written the chunk, or
+// once too many have failed for a quorum. Mirrors still writing
+// finish in the background, charging their failures to their budget
+func (t *MirrorTape) Write(ctx context.Context, data []byte, meta ChunkMeta) error {
+	cue := t.i.t
+	t.i.Key()
+
+	type result struct {
+		m   *mirror
+		err error
+	}
+	mirrors := t.b.healthy(time.Now())
+	results := make(chan result, len(mirrors))
+	t.b.pending.Add(len(mirrors))
+	for _, m := range mirrors {
+		go func(m *mirror) {
+			defer t.b.pending.Done()
+			blank, err := m.backend.BlankTape(ctx, t.name, Incrementer{cue})
+			if err == nil {
+				err = blank.tape.Write(ctx, data, meta)
+			}
+			if err != nil {
+				m.fail(time.Now())
+				metricMirrorErrors.Add(1, m.name)
+			}
+			results <- result{m, err}
+		}(m)
+	}
+
+	written, failed := 0, 0
+	var err error
+	for written < t.b.quorum && len(mirrors)-failed >= t.b.quorum {
+		r := <-results
+		if r.err == nil {
+			written++
+			continue
+		}
+		failed++
+		err = fmt.Errorf("mirror %s: %v", r.m.name, r.err)
+	}
+	if written < t.b.quorum {
+		return fmt.Errorf("%d of %d mirrors wrote the chunk, %d needed: %v", written, len(mirrors), t.b.quorum, err)
+	}
+	return nil
+}
+
+func (t *MirrorTape) Read(ctx context.Context) ([]byte, *ChunkMeta, error) {
+	cue := t.i.t
+	t.i.Key()
+
+	var err error
+	for _, m := range t.b.healthy(time.Now()) {
+		recorded, e := m.backend.RecordedTape(ctx, t.name, Incrementer{cue})
+		if e != nil {
+			err = e
+			continue
+		}
+		data, meta, e := recorded.tape.Read(ctx)
+		if e == nil {
+			e = meta.Verify(data)
+		}
+		if e == nil {
+			return data, meta, nil
+		}
+		err = e
+	}
+	return nil, nil, err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// gatedTapeBackend holds each write until its gate opens
+type gatedTapeBackend struct {
+	*memTapeBackend
+	gate chan struct{}
+}
+
+func (b *gatedTapeBackend) BlankTape(ctx context.Context, name string, i Incrementer) (*BlankTape, error) {
+	<-b.gate
+	return b.memTapeBackend.BlankTape(ctx, name, i)
+}
+
+func TestMirrorTapeBackend(t *testing.T) {
+	first, second := newMemTapeBackend(), newMemTapeBackend()
+	b := NewMirrorTapeBackend(1, 2)
+	b.Mirror("first", first)
+	b.Mirror("second", second)
+	if err := b.Init(); err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+	ctx := context.Background()
+	cue := time.Date(2017, 7, 30, 10, 0, 0, 0, time.UTC)
+
+	blank, _ := b.BlankTape(ctx, "wamc", Incrementer{cue})
+	if _, err := blank.Write(data); err != nil {
+		t.Fatalf("BlankTape Write() failed: %v", err)
+	}
+	b.pending.Wait()
+	if len(first.chunks) != 1 || len(second.chunks) != 1 {
+		t.Fatalf("chunk not mirrored: %d first, %d second", len(first.chunks), len(second.chunks))
+	}
+
+	// a failing mirror doesn't fail writes within the quorum,
+	// and is skipped once it spends its error budget
+	first.err = errors.New("down")
+	for i := 0; i < 4; i++ {
+		if _, err := blank.Write(data); err != nil {
+			t.Fatalf("BlankTape Write() failed within quorum: %v", err)
+		}
+		b.pending.Wait()
+	}
+	if first.writes != 3 || len(second.chunks) != 5 {
+		t.Errorf("spent mirror not skipped: %d writes to first, %d chunks on second", first.writes, len(second.chunks))
+	}
+
+	// reads fall through to the next healthy mirror
+	tape, _ := b.RecordedTape(ctx, "wamc", Incrementer{cue})
+	for i := 0; i < 5; i++ {
+		if d, err := tape.Read(); err != nil || !bytes.Equal(d, data) {
+			t.Errorf("chunk %d not played: %q, %v", i, d, err)
+		}
+	}
+
+	// without a quorum, writes fail
+	second.err = errors.New("down")
+	if _, err := blank.Write(data); err == nil {
+		t.Errorf("BlankTape Write() succeeded without a quorum")
+	}
+
+	// writes return once the quorum is written, and stragglers
+	// charge their failures to their budget in the background
+	slow := &gatedTapeBackend{newMemTapeBackend(), make(chan struct{})}
+	slow.err = errors.New("down")
+	b = NewMirrorTapeBackend(1, 1)
+	b.Mirror("fast", newMemTapeBackend())
+	b.Mirror("slow", slow)
+	blank, _ = b.BlankTape(ctx, "wamc", Incrementer{cue})
+	if _, err := blank.Write(data); err != nil {
+		t.Errorf("BlankTape Write() waited for a straggler: %v", err)
+	}
+	close(slow.gate)
+	b.pending.Wait()
+	if !b.mirrors[1].spent(time.Now(), 1) {
+		t.Errorf("straggler's failure not charged to its budget")
+	}
+
+	// and fail once the quorum can't be written
+	slow = &gatedTapeBackend{newMemTapeBackend(), make(chan struct{})}
+	down := newMemTapeBackend()
+	down.err = errors.New("down")
+	b = NewMirrorTapeBackend(2, 5)
+	b.Mirror("down", down)
+	b.Mirror("slow", slow)
+	blank, _ = b.BlankTape(ctx, "wamc", Incrementer{cue})
+	if _, err := blank.Write(data); err == nil {
+		t.Errorf("BlankTape Write() succeeded without a quorum")
+	}
+	close(slow.gate)
+	b.pending.Wait()
+
+	if err := NewMirrorTapeBackend(2, 1).Init(); err == nil {
+		t.Errorf("Init() accepted a quorum larger than the mirrors")
+	}
+}
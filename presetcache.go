@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// PresetResync is how often a watched preset cache is reloaded,
+// catching changes made while its watch was reconnecting
+const PresetResync = 10 * time.Minute
+
+// ErrWatchUnsupported is returned by backends that cannot watch
+// presets, so their presets are polled instead
+var ErrWatchUnsupported = errors.New("preset watch unsupported")
+
+// A PresetChange is a preset's new data, nil if it was removed
+type PresetChange struct {
+	Name string
+	Data []byte
+}
+
+// A PresetWatcher sends presets as they change until the context
+// is done, or returns an error when the watch fails. It calls ready
+// once the watch is established, before sending any change, so
+// presets read by ready miss none of the changes after them
+type PresetWatcher interface {
+	WatchPresets(ctx context.Context, ready func(), changes chan<- PresetChange) error
+}
+
+// A PresetEvent tells subscribers a station was added, changed or removed
+type PresetEvent struct {
+	Station Station
+	Removed bool
+}
+
+// A cachedPreset keeps a preset's data to tell when it changes
+type cachedPreset struct {
+	data    []byte
+	station Station
+}
+
+// Subscribe calls fn with each change to the cached presets,
+// from the goroutine that found the change
+func (p *Presets) Subscribe(fn func(PresetEvent)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subs = append(p.subs, fn)
+}
+
+// Reload reads every preset into the cache, telling
+// subscribers about the presets that differ from it
+func (p *Presets) Reload() error {
+	data, err := p.backend.ReadAllPresets()
+	if err != nil {
+		return err
+	}
+
+	cache := make(map[string]cachedPreset, len(data))
+	for _, d := range data {
+		s, err := stationFromData(d)
+		if err != nil {
+			level.Warn(logger).Log(
+				"msg", "Skipping bad preset",
+				"err", err)
+			continue
+		}
+		cache[s.Name] = cachedPreset{d, s}
+	}
+
+	p.mu.Lock()
+	old := p.cache
+	p.cache = cache
+	subs := p.subs
+	p.mu.Unlock()
+
+	var events []PresetEvent
+	for name, c := range cache {
+		if o, ok := old[name]; !ok || !bytes.Equal(o.data, c.data) {
+			events = append(events, PresetEvent{Station: c.station})
+		}
+	}
+	for name, o := range old {
+		if _, ok := cache[name]; !ok {
+			events = append(events, PresetEvent{Station: o.station, Removed: true})
+		}
+	}
+	for _, e := range events {
+		for _, fn := range subs {
+			fn(e)
+		}
+	}
+	return nil
+}
+
+// apply updates a cached preset, telling subscribers if it changed.
+// Nothing is cached until the presets are first loaded
+func (p *Presets) apply(name string, data []byte) error {
+	var e PresetEvent
+	if data != nil {
+		s, err := stationFromData(data)
+		if err != nil {
+			return err
+		}
+		e.Station = s
+	}
+
+	p.mu.Lock()
+	o, ok := p.cache[name]
+	switch {
+	case p.cache == nil, data == nil && !ok, ok && bytes.Equal(o.data, data):
+		p.mu.Unlock()
+		return nil
+	case data == nil:
+		delete(p.cache, name)
+		e = PresetEvent{Station: o.station, Removed: true}
+	default:
+		p.cache[name] = cachedPreset{data, e.Station}
+	}
+	subs := p.subs
+	p.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(e)
+	}
+	return nil
+}
+
+// Watch keeps the cache fresh until stopped, applying changes from
+// backends that watch their presets and reloading the others each poll
+func (p *Presets) Watch(stop <-chan struct{}, poll time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	w, watching := p.backend.(PresetWatcher)
+	for {
+		wait, reload := poll, true
+		if watching {
+			switch err := p.watch(ctx, w); err {
+			case nil:
+				// time to resync, which the next watch
+				// does once it is ready
+				wait, reload = 0, false
+			case ErrWatchUnsupported:
+				watching = false
+			default:
+				level.Warn(logger).Log(
+					"msg", "Preset watch failed",
+					"err", err)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+
+		if !reload {
+			continue
+		}
+		if err := p.Reload(); err != nil {
+			level.Warn(logger).Log(
+				"msg", "error reloading presets",
+				"err", err)
+		}
+	}
+}
+
+// watch reloads the cache once the watcher is ready, catching
+// changes made before the watch, then applies changes from the
+// watcher until it is time to resync
+func (p *Presets) watch(ctx context.Context, w PresetWatcher) error {
+	ctx, cancel := context.WithTimeout(ctx, PresetResync)
+	defer cancel()
+
+	ready := func() {
+		if err := p.Reload(); err != nil {
+			level.Warn(logger).Log(
+				"msg", "error reloading presets",
+				"err", err)
+		}
+	}
+	changes := make(chan PresetChange)
+	errc := make(chan error, 1)
+	go func() { errc <- w.WatchPresets(ctx, ready, changes) }()
+
+	for {
+		select {
+		case c := <-changes:
+			if err := p.apply(c.Name, c.Data); err != nil {
+				level.Warn(logger).Log(
+					"msg", "Skipping bad preset",
+					"station", c.Name,
+					"err", err)
+			}
+		case err := <-errc:
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err == nil {
+				err = errors.New("watch ended")
+			}
+			return err
+		}
+	}
+}
@@ -3,6 +3,9 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"sort"
+	"strconv"
+	"sync"
 
 	"context"
 
@@ -13,22 +16,49 @@ import (
 
 type Presets struct {
 	backend PresetBackend
+
+	// once Reload has loaded it, the cache holds every preset
+	// and lookups no longer read the backend
+	mu    sync.RWMutex
+	cache map[string]cachedPreset
+	subs  []func(PresetEvent)
 }
 
 type PresetBackend interface {
 	ReadPreset(key string) (data []byte, err error)
 	ReadAllPresets() (data [][]byte, err error)
 	WritePreset(key string, data []byte) error
+
+	// ListPresets returns up to limit presets following the cursor,
+	// and the cursor for the next page, empty after the last one
+	ListPresets(cursor string, limit int) (data [][]byte, next string, err error)
 }
 
+// Preset listing page sizes
+const (
+	defaultPresetPageSize = 100
+	presetPageSize        = 1000
+)
+
 // does this need to return an error? ping during init or something?
 func PresetsWithBackend(b PresetBackend) (*Presets, error) {
-	return &Presets{b}, nil
+	return &Presets{backend: b}, nil
 }
 
 func (p *Presets) Load() ([]Station, error) {
 	stations := []Station{}
 
+	p.mu.RLock()
+	if p.cache != nil {
+		for _, c := range p.cache {
+			stations = append(stations, c.station)
+		}
+		p.mu.RUnlock()
+		sort.Slice(stations, func(i, j int) bool { return stations[i].Name < stations[j].Name })
+		return stations, nil
+	}
+	p.mu.RUnlock()
+
 	data, err := p.backend.ReadAllPresets()
 	if err != nil {
 		return stations, errors.Wrap(err, "failed to read stations")
@@ -44,6 +74,25 @@ func (p *Presets) Load() ([]Station, error) {
 	return stations, nil
 }
 
+// List returns a page of stations and the cursor for the next
+func (p *Presets) List(cursor string, limit int) ([]Station, string, error) {
+	stations := []Station{}
+
+	data, next, err := p.backend.ListPresets(cursor, limit)
+	if err != nil {
+		return stations, "", errors.Wrap(err, "failed to list stations")
+	}
+
+	for _, d := range data {
+		s, err := stationFromData(d)
+		if err != nil {
+			return nil, "", err
+		}
+		stations = append(stations, s)
+	}
+	return stations, next, nil
+}
+
 func (p *Presets) Add(s Station) error {
 	data, err := json.Marshal(s)
 	if err != nil {
@@ -54,11 +103,22 @@ func (p *Presets) Add(s Station) error {
 		return errors.Wrap(err, "failed to write station")
 	}
 
-	return nil
+	return p.apply(s.Name, data)
 }
 
 // Lookup returns an initialized Station from the backend or an error
 func (p *Presets) Lookup(name string) (Station, error) {
+	p.mu.RLock()
+	if p.cache != nil {
+		c, ok := p.cache[name]
+		p.mu.RUnlock()
+		if !ok {
+			return Station{}, errors.Errorf("station not found: %s", name)
+		}
+		return c.station, nil
+	}
+	p.mu.RUnlock()
+
 	data, err := p.backend.ReadPreset(name)
 	if err != nil {
 		return Station{}, errors.Wrap(err, "station not found")
@@ -83,25 +143,82 @@ func stationFromData(data []byte) (Station, error) {
 
 // PresetService provides operations on Presets
 type PresetService interface {
-	List(context.Context) ([]Station, error)
+	List(ctx context.Context, cursor string, limit int) ([]Station, string, error)
+	Add(ctx context.Context, s Station) error
 }
 
 type presetService struct {
 	presets *Presets
 }
 
-func (p presetService) List(_ context.Context) ([]Station, error) {
-	return p.presets.Load()
+func (p presetService) List(_ context.Context, cursor string, limit int) ([]Station, string, error) {
+	return p.presets.List(cursor, limit)
+}
+
+func (p presetService) Add(_ context.Context, s Station) error {
+	return p.presets.Add(s)
+}
+
+// A statusError is served with its status code
+type statusError struct {
+	code int
+	err  error
 }
 
-type listRequest struct{}
+func (e statusError) Error() string   { return e.err.Error() }
+func (e statusError) StatusCode() int { return e.code }
+
+type listRequest struct {
+	Cursor string
+	Limit  int
+}
 type listResponse struct {
 	Presets []Station `json:"presets"`
+	Next    string    `json:"next,omitempty"`
 	Err     string    `json:"err,omitempty"`
 }
 
 func decodeListRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	return listRequest{}, nil
+	req := listRequest{
+		Cursor: r.URL.Query().Get("cursor"),
+		Limit:  defaultPresetPageSize,
+	}
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			return nil, errors.Errorf("invalid limit %q", l)
+		}
+		req.Limit = n
+	}
+	if req.Limit > presetPageSize {
+		req.Limit = presetPageSize
+	}
+	return req, nil
+}
+
+type addRequest struct {
+	Station Station
+}
+type addResponse struct {
+	Preset Station `json:"preset"`
+	Err    string  `json:"err,omitempty"`
+}
+
+func decodeAddRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		return nil, statusError{http.StatusMethodNotAllowed, errors.Errorf("%s not allowed", r.Method)}
+	}
+	var s Station
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		return nil, statusError{http.StatusBadRequest, errors.Wrap(err, "invalid station")}
+	}
+	if s.Name == "" || s.Url == "" {
+		return nil, statusError{http.StatusBadRequest, errors.New("station needs a name and url")}
+	}
+	if err := s.Init(); err != nil {
+		return nil, statusError{http.StatusBadRequest, err}
+	}
+	return addRequest{s}, nil
 }
 
 func encodeResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
@@ -110,15 +227,26 @@ func encodeResponse(_ context.Context, w http.ResponseWriter, response interface
 
 func makeListEndpoint(svc PresetService) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		presets, err := svc.List(ctx)
+		req := request.(listRequest)
+		presets, next, err := svc.List(ctx, req.Cursor, req.Limit)
 		if err != nil {
-			return listResponse{[]Station{}, err.Error()}, nil
+			return listResponse{[]Station{}, "", err.Error()}, nil
 		}
-		return listResponse{presets, ""}, nil
+		return listResponse{presets, next, ""}, nil
 	}
 }
 
-// Register the PresetService handlers with an http.ServeMux
+func makeAddEndpoint(svc PresetService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(addRequest)
+		if err := svc.Add(ctx, req.Station); err != nil {
+			return addResponse{req.Station, err.Error()}, nil
+		}
+		return addResponse{req.Station, ""}, nil
+	}
+}
+
+// Register the read only PresetService handlers with an http.ServeMux
 func (p *Presets) RegisterServiceHandlers(path string, mux *http.ServeMux) {
 	svc := presetService{presets: p}
 
@@ -130,3 +258,18 @@ func (p *Presets) RegisterServiceHandlers(path string, mux *http.ServeMux) {
 
 	mux.Handle(path+"list", listHandler)
 }
+
+// Register every PresetService handler, including those
+// that change presets, with an http.ServeMux
+func (p *Presets) RegisterAdminHandlers(path string, mux *http.ServeMux) {
+	p.RegisterServiceHandlers(path, mux)
+
+	svc := presetService{presets: p}
+	addHandler := httptransport.NewServer(
+		makeAddEndpoint(svc),
+		decodeAddRequest,
+		encodeResponse,
+	)
+
+	mux.Handle(path+"add", addHandler)
+}
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -30,7 +38,11 @@ type testPresetBackend struct {
 }
 
 func (b *testPresetBackend) ReadPreset(name string) (data []byte, err error) {
-	return []byte{}, nil
+	data, ok := b.data[name]
+	if !ok {
+		return nil, errors.New("no such preset")
+	}
+	return data, nil
 }
 
 func (b *testPresetBackend) ReadAllPresets() (data [][]byte, err error) {
@@ -40,6 +52,23 @@ func (b *testPresetBackend) ReadAllPresets() (data [][]byte, err error) {
 	return
 }
 
+func (b *testPresetBackend) ListPresets(cursor string, limit int) (data [][]byte, next string, err error) {
+	names := []string{}
+	for name := range b.data {
+		if name > cursor {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > limit {
+		names, next = names[:limit], names[limit-1]
+	}
+	for _, name := range names {
+		data = append(data, b.data[name])
+	}
+	return
+}
+
 func (b *testPresetBackend) WritePreset(name string, data []byte) error {
 	b.data[name] = data
 	return nil
@@ -69,3 +98,163 @@ func TestPresets(t *testing.T) {
 		t.Errorf("Presets.Load didn't match. Expected %v, got %v", expected, stations)
 	}
 }
+
+func TestPresetList(t *testing.T) {
+	p, _ := PresetsWithBackend(&testPresetBackend{
+		data: make(map[string][]byte),
+	})
+	for i := 0; i < 5; i++ {
+		s := ts
+		s.Name = fmt.Sprintf("station%d", i)
+		if err := p.Add(s); err != nil {
+			t.Fatalf("Presets.Add failed, %v", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	p.RegisterServiceHandlers("/preset/", mux)
+
+	var names []string
+	cursor := ""
+	for pages := 0; pages < 5; pages++ {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/preset/list?limit=2&cursor="+cursor, nil))
+
+		var resp listResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("unable to decode list response: %v", err)
+		}
+		if len(resp.Presets) > 2 {
+			t.Errorf("page too long. expected 2, got %d", len(resp.Presets))
+		}
+		for _, s := range resp.Presets {
+			names = append(names, s.Name)
+		}
+		if resp.Next == "" {
+			break
+		}
+		cursor = resp.Next
+	}
+
+	expected := []string{"station0", "station1", "station2", "station3", "station4"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("listed presets wrong. expected %v, got %v", expected, names)
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/preset/list?limit=lots", nil))
+	if rec.Code == http.StatusOK {
+		t.Errorf("bad limit accepted")
+	}
+}
+
+// watchedPresetBackend sends the changes written to it to its watcher
+type watchedPresetBackend struct {
+	testPresetBackend
+	changes chan PresetChange
+}
+
+func (b *watchedPresetBackend) WatchPresets(ctx context.Context, ready func(), changes chan<- PresetChange) error {
+	ready()
+	for {
+		select {
+		case c := <-b.changes:
+			changes <- c
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func TestPresetCache(t *testing.T) {
+	b := &watchedPresetBackend{
+		testPresetBackend{data: map[string][]byte{"wamc": []byte(tsjson)}},
+		make(chan PresetChange),
+	}
+	p, _ := PresetsWithBackend(b)
+	events := make(chan PresetEvent, 10)
+	p.Subscribe(func(e PresetEvent) { events <- e })
+
+	if err := p.Reload(); err != nil {
+		t.Fatalf("Presets.Reload failed, %v", err)
+	}
+	if e := <-events; e.Station.Name != "wamc" || e.Removed {
+		t.Errorf("expected an event adding wamc, got %+v", e)
+	}
+
+	// lookups no longer read the backend
+	delete(b.data, "wamc")
+	if _, err := p.Lookup("wamc"); err != nil {
+		t.Errorf("cached station not found: %v", err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go p.Watch(stop, time.Hour)
+
+	// the watch reloads once it is ready, catching the removal
+	if e := <-events; e.Station.Name != "wamc" || !e.Removed {
+		t.Errorf("expected an event removing wamc, got %+v", e)
+	}
+
+	kexp := strings.Replace(tsjson, "wamc", "kexp", 1)
+	b.changes <- PresetChange{"kexp", []byte(kexp)}
+	if e := <-events; e.Station.Name != "kexp" || e.Removed {
+		t.Errorf("expected an event adding kexp, got %+v", e)
+	}
+	if s, err := p.Lookup("kexp"); err != nil || s.Name != "kexp" {
+		t.Errorf("watched station not cached: %v", err)
+	}
+
+	// unchanged presets send no events
+	b.changes <- PresetChange{"kexp", []byte(kexp)}
+	b.changes <- PresetChange{"wamc", []byte(tsjson)}
+	if e := <-events; e.Station.Name != "wamc" || e.Removed {
+		t.Errorf("expected an event adding wamc, got %+v", e)
+	}
+	b.changes <- PresetChange{"wamc", nil}
+	if e := <-events; e.Station.Name != "wamc" || !e.Removed {
+		t.Errorf("expected an event removing wamc, got %+v", e)
+	}
+	if _, err := p.Lookup("wamc"); err == nil {
+		t.Errorf("removed station still cached")
+	}
+
+	stations, _ := p.Load()
+	if len(stations) != 1 || stations[0].Name != "kexp" {
+		t.Errorf("cached stations wrong, got %v", stations)
+	}
+}
+
+func TestPresetCachePoll(t *testing.T) {
+	b := &testPresetBackend{data: map[string][]byte{}}
+	p, _ := PresetsWithBackend(b)
+	if err := p.Reload(); err != nil {
+		t.Fatalf("Presets.Reload failed, %v", err)
+	}
+	events := make(chan PresetEvent, 10)
+	p.Subscribe(func(e PresetEvent) { events <- e })
+
+	// presets written through the cache are seen at once
+	if err := p.Add(ts); err != nil {
+		t.Fatalf("Presets.Add failed, %v", err)
+	}
+	if e := <-events; e.Station.Name != "wamc" {
+		t.Errorf("expected an event adding wamc, got %+v", e)
+	}
+
+	// presets written elsewhere are seen on the next poll
+	b.WritePreset("kexp", []byte(strings.Replace(tsjson, "wamc", "kexp", 1)))
+	stop := make(chan struct{})
+	defer close(stop)
+	go p.Watch(stop, 10*time.Millisecond)
+
+	select {
+	case e := <-events:
+		if e.Station.Name != "kexp" {
+			t.Errorf("expected an event adding kexp, got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("polled preset not seen")
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -11,8 +14,8 @@ import (
 
 	"github.com/cenkalti/backoff"
 	"github.com/go-kit/kit/log/level"
-	"github.com/gorilla/handlers"
 	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
 )
 
 type stopChan chan struct{}
@@ -21,35 +24,95 @@ type stopChan chan struct{}
 type RadioOptions struct {
 	Broadcast bool
 	Record    bool
+
+	// BufferChunks are sent ahead to fill a listener's buffer
+	BufferChunks int
+
+	// DST resolves listener times made ambiguous by
+	// daylight savings at a station
+	DST DSTPolicy
+
+	// CORSOrigins may make cross origin requests
+	CORSOrigins []string
+
+	// ReadyChunkAge, if set, is how recently a station must
+	// have recorded a chunk for the radio to be ready
+	ReadyChunkAge time.Duration
+
+	// SweepInterval, if set, is how often recorders delete
+	// chunks that the storage doesn't expire on its own
+	SweepInterval time.Duration
+
+	// PresetPoll, if set, caches presets and is how often they
+	// are reloaded from backends that cannot watch them
+	PresetPoll time.Duration
 }
 
 // A Radio manages all the stations and recordings
 type Radio struct {
 	Server   *http.Server
+	Admin    *http.Server // nil without an admin address
 	Presets  *Presets
 	TapeDeck *TapeDeck
 	Options  RadioOptions
+	Locator  *Locator
+	Auth     *ListenerAuth // nil to let anyone listen
+
+	// Streams caps concurrent streams and PresetLimit
+	// the rate of preset requests, no limit if nil
+	Streams     *StreamLimiter
+	PresetLimit *RateLimiter
 
 	PathBroadcast string
 	PathPreset    string
+	PathTapes     string
+
+	// AdminToken must be presented as a bearer token to Admin
+	AdminToken string
+
+	// Closers release the backends once the radio is off
+	Closers []io.Closer
 
 	stop stopChan
 	wg   *sync.WaitGroup
+
+	// recording stops each station's recorder
+	mu        sync.Mutex
+	recording map[string]stopChan
 }
 
 // Record tunes into a station and records to a blank tape
-func (r *Radio) StartRecording(s *Station) {
+// until the radio or the recording is stopped
+func (r *Radio) StartRecording(s *Station, stop stopChan) {
 	r.wg.Add(1)
 	defer r.wg.Done()
 
 	// Use a context to provide cancellation of the http client
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	go func() {
-		<-r.stop
+		select {
+		case <-r.stop:
+		case <-stop:
+		case <-ctx.Done():
+		}
 		cancel()
 	}()
 
-	rec := func() error {
+	// next is the cue following the last recorded chunk,
+	// so a reconnect can fill the gap it left behind
+	var next time.Time
+	attempts := 0
+
+	rec := func() (err error) {
+		if attempts++; attempts > 1 {
+			metricReconnects.Add(1, s.Name)
+		}
+
+		ctx, span := trace.StartSpan(ctx, "Radio.Record")
+		span.AddAttributes(trace.StringAttribute("station", s.Name))
+		defer func() { endSpan(span, err) }()
+
 		level.Debug(logger).Log(
 			"msg", "Initiating recording",
 			"station", s.Name)
@@ -70,20 +133,53 @@ func (r *Radio) StartRecording(s *Station) {
 			return err
 		}
 
-		tape, err := r.TapeDeck.BlankTape(ctx, s.Name, s.CurrentTime())
+		cue := s.CurrentTime()
+		start := cue
+		if !next.IsZero() {
+			// never fill further back than the tape would keep
+			start = next
+			if earliest := cue.Add(-TTL); start.Before(earliest) {
+				start = earliest
+			}
+		}
+
+		tape, err := r.TapeDeck.BlankTape(ctx, s.Name, start)
 		if err != nil {
 			level.Warn(logger).Log(
 				"msg", "error loading blank tape",
 				"err", err)
 			return err
 		}
+		defer func() { next = tape.Next() }()
+
+		if start.Before(cue) {
+			n, err := tape.Fill(cue, stream)
+			if err != nil {
+				level.Warn(logger).Log(
+					"msg", "error filling recording gap",
+					"station", s.Name,
+					"err", err)
+				if tape, err = r.TapeDeck.BlankTape(ctx, s.Name, cue); err != nil {
+					level.Warn(logger).Log(
+						"msg", "error loading blank tape",
+						"err", err)
+					return err
+				}
+			} else {
+				metricChunksWritten.Add(float64(n), s.Name, "true")
+				level.Info(logger).Log(
+					"msg", fmt.Sprintf("Filled recording gap with %d silent chunks", n),
+					"station", s.Name,
+					"from", start.Format(time.RFC3339))
+			}
+		}
 
 		size := stream.Chunksize()
 		level.Debug(logger).Log(
 			"msg", fmt.Sprintf("Recording station with chunksize %d", size),
 			"station", s.Name)
 
-		if err := ChunkPipe(size, stream, tape); err != nil {
+		if err := ChunkPipe(size, stream, steadyTape{tape, s, stream}); err != nil {
 			if strings.HasSuffix(err.Error(), "context canceled") {
 				level.Debug(logger).Log(
 					"msg", "canceled stream",
@@ -130,6 +226,99 @@ func (r *Radio) StartRecording(s *Station) {
 		"station", s.Name)
 }
 
+// record starts recording a station, stopping any
+// recording of it already running
+func (r *Radio) record(s Station) {
+	stop := make(stopChan)
+
+	r.mu.Lock()
+	if old, ok := r.recording[s.Name]; ok {
+		close(old)
+	}
+	r.recording[s.Name] = stop
+	r.mu.Unlock()
+
+	go r.StartRecording(&s, stop)
+}
+
+// stopRecording stops recording a station
+func (r *Radio) stopRecording(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if stop, ok := r.recording[name]; ok {
+		close(stop)
+		delete(r.recording, name)
+		metricLastChunk.Delete(name)
+	}
+}
+
+// retune follows preset changes, recording added stations,
+// restarting changed ones and stopping removed ones
+func (r *Radio) retune(e PresetEvent) {
+	if e.Removed {
+		level.Info(logger).Log(
+			"msg", "Preset removed, stopping recording",
+			"station", e.Station.Name)
+		r.stopRecording(e.Station.Name)
+		return
+	}
+
+	level.Info(logger).Log(
+		"msg", "Recording preset",
+		"station", e.Station.Name)
+	r.record(e.Station)
+}
+
+// A steadyTape re-anchors a BlankTape to the station's clock
+// when its chunk keys drift too far from when the chunks arrive
+type steadyTape struct {
+	*BlankTape
+	station *Station
+	stream  *Stream
+}
+
+// Writer interface
+func (t steadyTape) Write(p []byte) (n int, err error) {
+	if n, err = t.BlankTape.Write(p); err != nil {
+		metricWriteErrors.Add(1, t.station.Name)
+		return
+	}
+
+	now := time.Now()
+	drift := t.Drift(now)
+	metricRecordedBytes.Add(float64(n), t.station.Name)
+	metricChunksWritten.Add(1, t.station.Name, "false")
+	metricLastChunk.Set(float64(now.Unix()), t.station.Name)
+	metricDrift.Set(drift.Seconds(), t.station.Name)
+
+	if drift < DriftThreshold && drift > -DriftThreshold {
+		return
+	}
+
+	cue := t.station.CurrentTime()
+	level.Warn(logger).Log(
+		"msg", "Re-anchoring drifting recording",
+		"station", t.station.Name,
+		"drift", drift,
+		"cue", cue.Format(time.RFC3339))
+
+	// a stream that fell behind leaves a gap to fill,
+	// one that ran ahead is rewound over its own chunks
+	if cue.After(t.Next()) {
+		if filled, err := t.Fill(cue, t.stream); err == nil {
+			metricChunksWritten.Add(float64(filled), t.station.Name, "true")
+			return n, nil
+		}
+	}
+	if err := t.Seek(cue); err != nil {
+		level.Warn(logger).Log(
+			"msg", "error re-anchoring recording",
+			"station", t.station.Name,
+			"err", err)
+	}
+	return n, nil
+}
+
 // Turn on the radio and start recording presets
 func (r *Radio) On() {
 	level.Info(logger).Log(
@@ -140,51 +329,84 @@ func (r *Radio) On() {
 	r.stop = make(stopChan)
 	r.wg = &sync.WaitGroup{}
 	r.wg.Add(1)
+	r.recording = make(map[string]stopChan)
 
 	if r.Options.Record {
 		level.Info(logger).Log("msg", "Starting to record presets")
+	}
 
+	// the first load of the cache tells the recorders every
+	// preset, and later ones which have changed
+	if r.Options.PresetPoll > 0 {
+		if r.Options.Record {
+			r.Presets.Subscribe(r.retune)
+		}
+		if err := r.Presets.Reload(); err != nil {
+			level.Warn(logger).Log(
+				"msg", "error loading presets",
+				"err", err)
+		}
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.Presets.Watch(r.stop, r.Options.PresetPoll)
+		}()
+	} else if r.Options.Record {
 		stations, err := r.Presets.Load()
 		if err != nil {
 			level.Warn(logger).Log(
 				"msg", "error loading presets",
 				"err", err)
 		}
-
 		for _, s := range stations {
-			s := s
-			err = s.Init()
-			if err != nil {
-				level.Warn(logger).Log(
-					"msg", "error loading preset",
-					"station", s.Name,
-					"err", err)
-				continue
-			}
-			go r.StartRecording(&s)
+			r.record(s)
+		}
+	}
+
+	if r.Options.Record {
+		// move recorded chunks between storage tiers
+		if tiered, ok := r.TapeDeck.backend.(*TieredTapeBackend); ok {
+			r.wg.Add(1)
+			go func() {
+				defer r.wg.Done()
+				tiered.Run(r.stop, r.Presets.Load)
+			}()
+		}
+
+		// delete chunks the storage doesn't expire
+		if sweeper, ok := r.TapeDeck.backend.(Sweeper); ok && r.Options.SweepInterval > 0 {
+			r.wg.Add(1)
+			go func() {
+				defer r.wg.Done()
+				RunSweeper(r.stop, sweeper, r.Options.SweepInterval)
+			}()
 		}
 
 		// r.ManageRecordings(r.stop, r.wg)
 	}
 
+	r.Server.Handler = r.publicHandler()
 	if r.Options.Broadcast {
-		r.Presets.RegisterServiceHandlers(r.PathPreset, http.DefaultServeMux)
-		http.HandleFunc(r.PathBroadcast, r.Broadcast)
-
-		// enable cors
-		cors := handlers.CORS(
-			handlers.AllowedHeaders([]string{"Content-Type"}),
-			handlers.AllowedMethods([]string{"GET", "POST"}),
-			handlers.AllowedOrigins([]string{"*"}))
-		r.Server.Handler = cors(http.DefaultServeMux)
-
 		level.Info(logger).Log("msg", "Starting broadcast and preset service")
 	}
 
-	// simple healthcheck
-	http.HandleFunc("/", http.HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) },
-	))
+	if r.Admin != nil {
+		r.Admin.Handler = r.adminHandler()
+		go func() {
+			if err := r.Admin.ListenAndServe(); err != http.ErrServerClosed {
+				level.Error(logger).Log(
+					"msg", "Admin service failed",
+					"addr", r.Admin.Addr,
+					"err", err)
+				os.Exit(1)
+			}
+		}()
+		level.Info(logger).Log(
+			"msg", "Starting admin service",
+			"addr", r.Admin.Addr)
+	} else {
+		level.Warn(logger).Log("msg", "No admin address, so status, tape coverage, metrics and profiling are not served")
+	}
 
 	go r.Server.ListenAndServe()
 	level.Info(logger).Log("msg", "Time machine is operational")
@@ -193,26 +415,75 @@ func (r *Radio) On() {
 func (r *Radio) Off() {
 	level.Info(logger).Log("msg", "Powering down the time machine")
 
-	timeout, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	r.Server.Shutdown(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r.Server.Shutdown(ctx)
+	if r.Admin != nil {
+		r.Admin.Shutdown(ctx)
+	}
 	close(r.stop)
 	r.wg.Done()
 	r.wg.Wait()
+	for _, c := range r.Closers {
+		if err := c.Close(); err != nil {
+			level.Warn(logger).Log(
+				"msg", "Cannot close backend",
+				"err", err)
+		}
+	}
 }
 
 // Broadcast listens for requests and streams a station
 func (r *Radio) Broadcast(rw http.ResponseWriter, req *http.Request) {
-	sp, err := ParsePath(strings.TrimPrefix(req.URL.Path, r.PathBroadcast))
+	ctx, span := trace.StartSpan(req.Context(), "Radio.Broadcast")
+	span.AddAttributes(trace.StringAttribute("client", req.RemoteAddr))
+	defer span.End()
+
+	sp, err := ParsePath(strings.TrimPrefix(req.URL.Path, r.PathBroadcast), req.URL.Query())
 	if err != nil {
 		level.Warn(logger).Log(
 			"msg", "Failed to broadcast",
 			"client", req.RemoteAddr,
 			"err", err)
 
-		http.NotFound(rw, req)
+		writeJSON(rw, http.StatusBadRequest, err)
 		return
 	}
 
+	if sp.listenerLocation == nil {
+		if sp.listenerLocation, err = r.locate(req); err != nil {
+			level.Warn(logger).Log(
+				"msg", "Failed to broadcast",
+				"client", req.RemoteAddr,
+				"err", err)
+
+			writeJSON(rw, http.StatusBadRequest, &PathError{Err: "missing listener zone"})
+			return
+		}
+	}
+	rw.Header().Set("X-Listener-Zone", sp.listenerLocation.String())
+
+	listener, signed := anonymousListener, false
+	if r.Auth != nil {
+		var authErr *AuthError
+		if listener, signed, authErr = r.Auth.Authenticate(req, sp.stationName, time.Now()); authErr != nil {
+			metricAuthRejections.Add(1, authErr.Kind)
+			logLevel := level.Info
+			if authErr.Err != nil {
+				logLevel = level.Warn
+			}
+			logLevel(logger).Log(
+				"msg", "Refused to broadcast",
+				"station", sp.stationName,
+				"client", req.RemoteAddr,
+				"listener", listener,
+				"err", authErr)
+
+			writeJSON(rw, authErr.Status, &PathError{Err: authErr.Reason})
+			return
+		}
+	}
+
 	s, err := r.Presets.Lookup(sp.stationName)
 	if err != nil {
 		level.Warn(logger).Log(
@@ -225,8 +496,28 @@ func (r *Radio) Broadcast(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	listenerTime := s.ListenerTime(sp.listenerLocation)
-	tape, err := r.TapeDeck.RecordedTape(req.Context(), s.Name, listenerTime)
+	span.AddAttributes(
+		trace.StringAttribute("station", s.Name),
+		trace.StringAttribute("zone", sp.listenerLocation.String()))
+
+	if r.Streams != nil {
+		release, limitErr := r.Streams.Acquire(r.clientIP(req), listener, s.Name)
+		if limitErr != nil {
+			level.Info(logger).Log(
+				"msg", "Refused to broadcast",
+				"station", s.Name,
+				"client", req.RemoteAddr,
+				"listener", listener,
+				"err", limitErr)
+
+			limitErr.write(rw)
+			return
+		}
+		defer release()
+	}
+
+	listenerTime := s.ListenerTime(sp.listenerLocation, r.Options.DST)
+	tape, err := r.TapeDeck.RecordedTape(ctx, s.Name, listenerTime)
 	if err != nil {
 		level.Warn(logger).Log(
 			"msg", "error loading recorded tape",
@@ -241,26 +532,120 @@ func (r *Radio) Broadcast(rw http.ResponseWriter, req *http.Request) {
 	level.Debug(logger).Log(
 		"msg", "Broadcasting station",
 		"station", s.Name,
-		"client", req.RemoteAddr)
+		"client", req.RemoteAddr,
+		"listener", listener)
 
 	// Set up trailers
 	// thanks http://engineering.pivotal.io/post/http-trailers/
 	trailerKey := http.CanonicalHeaderKey("X-Streaming-Error")
 	rw.Header().Set("Trailer", trailerKey)
 
+	metricListeners.Add(1, s.Name)
+	defer metricListeners.Add(-1, s.Name)
+	// signed url clients are unbounded, so they share a label
+	if signed {
+		metricListenerStreams.Add(1, s.Name, signedListener)
+	} else {
+		metricListenerStreams.Add(1, s.Name, listener)
+	}
+
 	if err := r.Stream(tape, rw); err != nil {
+		metricStreamErrors.Add(1, s.Name, streamErrorKind(err))
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
 		level.Debug(logger).Log(
 			"msg", "writing trailers",
 			"station", s.Name,
 			"client", req.RemoteAddr,
 			"err", err)
-		writeTrailers(err, rw, trailerKey)
+		// nobody is left to read trailers once the listener goes
+		if ctx.Err() == nil {
+			writeTrailers(err, rw, trailerKey)
+		}
 	}
 
 	level.Debug(logger).Log(
 		"msg", "Broadcast complete",
 		"station", s.Name,
-		"client", req.RemoteAddr)
+		"client", req.RemoteAddr,
+		"listener", listener)
+}
+
+// Coverage reports the time ranges recorded for a station,
+// by default over the last TTL
+func (r *Radio) Coverage(rw http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, r.PathTapes), "/")
+	if len(parts) != 2 || parts[1] != "coverage" {
+		writeJSON(rw, http.StatusNotFound, &PathError{Err: "not found"})
+		return
+	}
+
+	s, err := r.Presets.Lookup(parts[0])
+	if err != nil {
+		writeJSON(rw, http.StatusNotFound, &PathError{Err: err.Error()})
+		return
+	}
+
+	to := time.Now()
+	from := to.Add(-TTL)
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		v := req.URL.Query().Get(p.name)
+		if v == "" {
+			continue
+		}
+		if *p.t, err = time.Parse(time.RFC3339, v); err != nil {
+			writeJSON(rw, http.StatusBadRequest, &PathError{Err: fmt.Sprintf("invalid %s time %q", p.name, v)})
+			return
+		}
+	}
+	if !from.Before(to) {
+		writeJSON(rw, http.StatusBadRequest, &PathError{Err: "from must be before to"})
+		return
+	}
+
+	c, err := r.TapeDeck.Coverage(req.Context(), s.Name, from, to)
+	if err != nil {
+		level.Warn(logger).Log(
+			"msg", "Failed to list chunks",
+			"station", s.Name,
+			"err", err)
+		writeJSON(rw, http.StatusBadGateway, &PathError{Err: "backend error"})
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, struct {
+		Station string `json:"station"`
+		*Coverage
+	}{s.Name, c})
+}
+
+// locate infers the listener's zone from their address
+func (r *Radio) locate(req *http.Request) (*time.Location, error) {
+	if r.Locator == nil || r.Locator.DB == nil {
+		return nil, errors.New("no geoip database configured")
+	}
+	return r.Locator.Locate(req)
+}
+
+// clientIP names the client that made the request, by
+// address once trusted proxies are walked back through
+func (r *Radio) clientIP(req *http.Request) string {
+	l := r.Locator
+	if l == nil {
+		l = &Locator{}
+	}
+	if ip := l.ClientIP(req); ip != nil {
+		return ip.String()
+	}
+	return req.RemoteAddr
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
 }
 
 func writeTrailers(err error, rw http.ResponseWriter, trailerKey string) {
@@ -285,9 +670,30 @@ var (
 	errStreamWriteError = errors.New("client error")
 )
 
+// streamErrorKind names the errStream error for metrics
+func streamErrorKind(err error) string {
+	switch err {
+	case errStreamCanceled:
+		return "canceled"
+	case errStreamReadError:
+		return "backend"
+	case errStreamWriteError:
+		return "client"
+	}
+	return "unknown"
+}
+
 func (r *Radio) Stream(t *RecordedTape, rw http.ResponseWriter) error {
+	ctx := t.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	pushchunk := func() error {
-		chunk, err := t.tape.Read()
+		chunk, err := t.Read()
+		if err != nil && ctx.Err() != nil {
+			return errStreamCanceled
+		}
 		if err != nil {
 			level.Warn(logger).Log(
 				"msg", "error reading from tape",
@@ -304,7 +710,11 @@ func (r *Radio) Stream(t *RecordedTape, rw http.ResponseWriter) error {
 	}
 
 	// push some chunks to the client's buffer
-	for i := 0; i < BufferChunks; i++ {
+	buffer := r.Options.BufferChunks
+	if buffer == 0 {
+		buffer = BufferChunks
+	}
+	for i := 0; i < buffer; i++ {
 		if err := pushchunk(); err != nil {
 			return err
 		}
@@ -318,6 +728,9 @@ func (r *Radio) Stream(t *RecordedTape, rw http.ResponseWriter) error {
 		case <-r.stop:
 			level.Debug(logger).Log("msg", "canceling stream")
 			return errStreamCanceled
+		case <-ctx.Done():
+			level.Debug(logger).Log("msg", "listener went away")
+			return errStreamCanceled
 		case <-ticker.C:
 			if err := pushchunk(); err != nil {
 				return err
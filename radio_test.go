@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 // TODO: make this do something
@@ -24,3 +28,45 @@ func TestListen(t *testing.T) {
 		defer f.Close()
 	}
 }
+
+func TestCoverageHandler(t *testing.T) {
+	p, _ := PresetsWithBackend(&testPresetBackend{data: make(map[string][]byte)})
+	p.Add(ts)
+	tapes := &testTapeBackend{}
+	r := &Radio{
+		Presets:   p,
+		TapeDeck:  &TapeDeck{backend: tapes},
+		PathTapes: "/tapes/",
+	}
+
+	from := time.Date(2017, 7, 30, 3, 0, 0, 0, time.UTC)
+	tapes.chunks = []time.Time{from.Add(20 * time.Second), from.Add(40 * time.Second)}
+
+	cts := []struct {
+		path   string
+		status int
+	}{
+		{"/tapes/wamc/coverage?from=2017-07-30T03:00:00Z&to=2017-07-30T04:00:00Z", http.StatusOK},
+		{"/tapes/wamc/coverage?from=yesterday", http.StatusBadRequest},
+		{"/tapes/wamc/coverage?from=2017-07-30T04:00:00Z&to=2017-07-30T03:00:00Z", http.StatusBadRequest},
+		{"/tapes/wamc/elsewhere", http.StatusNotFound},
+	}
+
+	for _, ct := range cts {
+		rec := httptest.NewRecorder()
+		r.Coverage(rec, httptest.NewRequest("GET", ct.path, nil))
+		if rec.Code != ct.status {
+			t.Errorf("status for %s wrong. expected %d, got %d", ct.path, ct.status, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	r.Coverage(rec, httptest.NewRequest("GET", cts[0].path, nil))
+	var c Coverage
+	if err := json.NewDecoder(rec.Body).Decode(&c); err != nil {
+		t.Fatalf("unable to decode coverage: %v", err)
+	}
+	if len(c.Recorded) != 1 || len(c.Gaps) != 2 {
+		t.Errorf("expected one recorded range and two gaps, got %+v", c)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"strconv"
 	"strings"
 	"testing"
@@ -42,15 +44,39 @@ func TestRedis(t *testing.T) {
 		t.Fatalf("unable to get miniredis port")
 	}
 
+	// a chunk recorded before there were chunk indexes
+	unindexed := time.Now().Truncate(time.Second * ChunkSeconds).UTC()
+	s.Set("chunk:unindexed:"+unindexed.Format(time.RFC3339), "chunk")
+
 	b.host = parts[0]
 	b.port = port
 	if b.Init(); err != nil {
 		t.Fatalf("miniredis can't ping: %v", err)
 	}
 
+	chunks, err := b.ListChunks(context.Background(), "unindexed", unindexed, unindexed.Add(time.Minute))
+	if err != nil || len(chunks) != 1 || !chunks[0].Equal(unindexed) {
+		t.Errorf("chunk recorded before the index not listed: %v %v", chunks, err)
+	}
+
+	if _, err := b.ReadKey(HashKey("nope")); err != ErrKeyNotFound {
+		t.Errorf("ReadKey of a missing key = %v, want ErrKeyNotFound", err)
+	}
+
 	// Now run subtests with our prepared backend
+	t.Run("Ping", testRedisPing)
 	t.Run("Presets", testRedisPresets)
+	t.Run("PresetIndex", testRedisPresetIndex)
 	t.Run("Tapes", testRedisTapes)
+	t.Run("SSDBTapes", testRedisSSDBTapes)
+	t.Run("ListChunks", testRedisListChunks)
+	t.Run("MigrateKeys", testRedisMigrateKeys)
+}
+
+func testRedisPing(t *testing.T) {
+	if err := b.Ping(context.Background()); err != nil {
+		t.Fatalf("miniredis can't ping: %v", err)
+	}
 }
 
 func testRedisPresets(t *testing.T) {
@@ -82,6 +108,47 @@ func testRedisPresets(t *testing.T) {
 	}
 }
 
+func testRedisPresetIndex(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		if err := b.WritePreset(fmt.Sprintf("page%d", i), data); err != nil {
+			t.Fatalf("miniredis failed")
+		}
+	}
+
+	// pages hold the presets in name order
+	var n int
+	cursor := ""
+	for {
+		page, next, err := b.ListPresets(cursor, 2)
+		if err != nil {
+			t.Fatalf("ListPresets failed: %v", err)
+		}
+		n += len(page)
+		if next == "" {
+			break
+		}
+		if next <= cursor {
+			t.Fatalf("cursor went backwards from %q to %q", cursor, next)
+		}
+		cursor = next
+	}
+	if n != 6 {
+		t.Errorf("listed %d presets, expected 6", n)
+	}
+
+	// presets written before the index are indexed on init
+	if err := b.client.Del(presetIndex).Err(); err != nil {
+		t.Fatalf("miniredis failed")
+	}
+	if err := b.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	ds, err := b.ReadAllPresets()
+	if err != nil || len(ds) != 6 {
+		t.Errorf("expected 6 presets after reindexing, got %d: %v", len(ds), err)
+	}
+}
+
 func testRedisTapes(t *testing.T) {
 	cue := time.Now()
 	blank, err := b.BlankTape(context.Background(), name, Incrementer{cue})
@@ -90,12 +157,160 @@ func testRedisTapes(t *testing.T) {
 	}
 
 	tape, err := b.RecordedTape(context.Background(), name, Incrementer{cue})
-	d, err := tape.tape.Read()
+	d, err := tape.Read()
+	if err != nil {
+		t.Fatalf("miniredis failed")
+	}
+
+	if !bytes.Equal(d, data) {
+		t.Errorf("retrieved data doesn't match. expected %b, got %b\n", data, d)
+	}
+
+	key := fmt.Sprintf("%s:%s", name, cue.UTC().Format(time.RFC3339))
+	length, err := b.client.HGet("chunkmeta:"+key, "length").Result()
+	if err != nil || length != strconv.Itoa(len(data)) {
+		t.Errorf("chunk metadata wrong. expected length %d, got %q (%v)", len(data), length, err)
+	}
+
+	// a chunk that no longer matches its checksum is not played
+	b.client.Set("chunk:"+key, "this is the station you are looking for", TTL)
+	tape, _ = b.RecordedTape(context.Background(), name, Incrementer{cue})
+	if _, err := tape.Read(); err != errChunkCorrupt {
+		t.Errorf("corrupt chunk read, got %v", err)
+	}
+}
+
+func testRedisSSDBTapes(t *testing.T) {
+	ssdb := *b
+	ssdb.ssdb = true
+	ctx := context.Background()
+	cue := time.Now()
+
+	// miniredis can't setx, so the chunk is stored as ssdb stores it
+	key := fmt.Sprintf("%s:%s", name, cue.UTC().Format(time.RFC3339))
+	m, _ := json.Marshal(NewChunkMeta(data, false))
+	b.client.Set("chunk:"+key, data, TTL)
+	b.client.Set("chunkmeta:"+key, m, TTL)
+
+	tape, _ := ssdb.RecordedTape(ctx, name, Incrementer{cue})
+	d, meta, err := tape.tape.Read(ctx)
+	if err != nil || !bytes.Equal(d, data) || meta == nil || meta.Length != len(data) {
+		t.Fatalf("ssdb chunk read wrong: %q %+v %v", d, meta, err)
+	}
+
+	b.client.Set("chunk:"+key, "this is the station you are looking for", TTL)
+	tape, _ = ssdb.RecordedTape(ctx, name, Incrementer{cue})
+	if _, err := tape.Read(); err != errChunkCorrupt {
+		t.Errorf("corrupt ssdb chunk read, got %v", err)
+	}
+}
+
+func testRedisListChunks(t *testing.T) {
+	cue := time.Now().Truncate(time.Second * ChunkSeconds)
+	for _, c := range []time.Time{cue, cue.Add(time.Hour)} {
+		blank, _ := b.BlankTape(context.Background(), "chunks", Incrementer{c})
+		for i := 0; i < 3; i++ {
+			if _, err := blank.Write(data); err != nil {
+				t.Fatalf("miniredis failed")
+			}
+		}
+	}
+
+	chunks, err := b.ListChunks(context.Background(), "chunks", cue.Add(20*time.Second), cue.Add(time.Hour+40*time.Second))
 	if err != nil {
+		t.Fatalf("ListChunks failed: %v", err)
+	}
+	expected := []time.Time{
+		cue.Add(20 * time.Second),
+		cue.Add(40 * time.Second),
+		cue.Add(time.Hour),
+		cue.Add(time.Hour + 20*time.Second),
+	}
+	if len(chunks) != len(expected) {
+		t.Fatalf("listed chunks wrong. expected %v, got %v", expected, chunks)
+	}
+	for i := range chunks {
+		if !chunks[i].Equal(expected[i]) {
+			t.Errorf("listed chunks wrong. expected %v, got %v", expected, chunks)
+			break
+		}
+	}
+	// deleted chunks are unlisted along with their metadata
+	if err := b.DeleteChunk(context.Background(), "chunks", cue.Add(time.Hour)); err != nil {
+		t.Fatalf("DeleteChunk failed: %v", err)
+	}
+	chunks, _ = b.ListChunks(context.Background(), "chunks", cue, cue.Add(2*time.Hour))
+	if len(chunks) != 5 {
+		t.Errorf("expected 5 chunks after deleting one, got %v", chunks)
+	}
+	k := "chunks:" + cue.Add(time.Hour).UTC().Format(time.RFC3339)
+	if n, _ := b.client.Exists("chunk:"+k, "chunkmeta:"+k).Result(); n != 0 {
+		t.Errorf("deleted chunk still stored")
+	}
+}
+
+func testRedisMigrateKeys(t *testing.T) {
+	old := "chunk:" + name + ":2017-07-30T06:13:00-04:00"
+	if err := b.client.Set(old, data, TTL).Err(); err != nil {
 		t.Fatalf("miniredis failed")
 	}
 
+	// a chunk recorded again under its canonical key is kept
+	stale := "chunk:" + name + ":2017-07-30T06:13:10-04:00"
+	newer := "chunk:" + name + ":2017-07-30T10:13:10Z"
+	b.client.Set(stale, "stale", TTL)
+	b.client.Set(newer, data, TTL)
+
+	n, collided, err := b.MigrateKeys(context.Background(), true)
+	if err != nil || n != 1 || collided != 1 {
+		t.Fatalf("dry run migrated %d keys, %d collided: %v", n, collided, err)
+	}
+
+	n, collided, err = b.MigrateKeys(context.Background(), false)
+	if err != nil || n != 1 || collided != 1 {
+		t.Fatalf("migrated %d keys, %d collided: %v", n, collided, err)
+	}
+
+	d, err := b.client.Get("chunk:" + name + ":2017-07-30T10:13:00Z").Bytes()
+	if err != nil {
+		t.Fatalf("migrated key not found")
+	}
 	if !bytes.Equal(d, data) {
 		t.Errorf("retrieved data doesn't match. expected %b, got %b\n", data, d)
 	}
+	if d, _ := b.client.Get(newer).Bytes(); !bytes.Equal(d, data) {
+		t.Errorf("colliding chunk replaced, got %q", d)
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	s.RequireAuth("hunter2")
+
+	backend := &RedisBackend{addrs: []string{s.Addr()}, password: "wrong"}
+	if err := backend.Init(); err == nil {
+		t.Fatalf("connected with the wrong password")
+	}
+
+	backend = &RedisBackend{addrs: []string{s.Addr()}, password: "hunter2", db: 3}
+	if err := backend.Init(); err != nil {
+		t.Fatalf("unable to connect with a password: %v", err)
+	}
+	if err := backend.WritePreset(name, data); err != nil {
+		t.Fatalf("miniredis failed: %v", err)
+	}
+	if !s.DB(3).Exists("preset:" + name) {
+		t.Errorf("preset not written to the selected database")
+	}
+
+	// ACL users authenticate with both name and password,
+	// which miniredis rejects
+	backend = &RedisBackend{addrs: []string{s.Addr()}, user: "radio", password: "hunter2"}
+	if err := backend.Init(); err == nil || !strings.Contains(err.Error(), "auth") {
+		t.Errorf("expected an auth error for an ACL user, got %v", err)
+	}
 }
@@ -9,6 +9,7 @@ import (
 	"context"
 
 	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
 )
 
 // Station represents a radio station and its location
@@ -31,7 +32,11 @@ func (s *Station) Init() error {
 }
 
 // Tune into the station, and return a stream, or error
-func (s *Station) Tune(ctx context.Context) (*Stream, error) {
+func (s *Station) Tune(ctx context.Context) (_ *Stream, err error) {
+	ctx, span := trace.StartSpan(ctx, "Station.Tune")
+	span.AddAttributes(trace.StringAttribute("station", s.Name))
+	defer func() { endSpan(span, err) }()
+
 	req, err := http.NewRequest("GET", s.Url, nil)
 	req = req.WithContext(ctx)
 
@@ -46,6 +51,7 @@ func (s *Station) Tune(ctx context.Context) (*Stream, error) {
 		res.Body.Close()
 		return nil, errors.Wrapf(err, "error detecting bitrate for %s", s.Name)
 	}
+	span.AddAttributes(trace.Int64Attribute("bitrate", int64(bitrate)))
 
 	s.stream = &Stream{
 		Bitrate: bitrate,
@@ -58,27 +64,16 @@ func (s *Station) Tune(ctx context.Context) (*Stream, error) {
 // CurrentTime returns a time.Time in station's location,
 // truncated to the chunkduration boundary
 func (s *Station) CurrentTime() time.Time {
-	now := time.Now().In(s.loc)
-	trunc := (now.Second() % ChunkSeconds) * int(time.Second)
-	return now.Add(time.Duration(-trunc))
+	return time.Now().In(s.loc).Truncate(time.Second * ChunkSeconds)
 }
 
 // ListenerTime returns a time.Time in the station's location
 // with the hours set to the current hours in the specified location
-// and truncated to the chunkduration boundary
-func (s *Station) ListenerTime(loc *time.Location) time.Time {
-	now := s.CurrentTime()
-	distance := s.ListenerDistance(loc)
-	if distance >= 0 {
-		distance -= 24 * 60
-	}
-	return now.Add(time.Duration(distance) * time.Minute)
-}
-
-// ListenerDistance returns the number of minutes offset
-// the listener is from the station
-func (s *Station) ListenerDistance(l *time.Location) int {
-	return LocationDistanceInMinutes(time.Now(), l, s.loc)
+// and truncated to the chunkduration boundary. Times made ambiguous
+// by daylight savings at the station are resolved by the policy
+func (s *Station) ListenerTime(loc *time.Location, policy DSTPolicy) time.Time {
+	t := ListenerTimeAt(time.Now(), loc, s.loc, policy)
+	return t.Truncate(time.Second * ChunkSeconds)
 }
 
 // A stream represents a tuned-in radio station
@@ -1,24 +1,119 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"context"
+
+	"github.com/go-kit/kit/log/level"
 )
 
 const TTL = time.Duration(24 * time.Hour)
 
+// DriftThreshold is how far a recording's chunk keys may stray
+// from the time the chunks are received before it is re-anchored
+const DriftThreshold = time.Duration(2 * ChunkSeconds * time.Second)
+
 // A TapeDeck is the backend that records and plays tapes
 type TapeDeck struct {
 	backend TapeBackend
+	driver  string
 }
 
 func (deck *TapeDeck) BlankTape(ctx context.Context, name string, cue time.Time) (*BlankTape, error) {
-	return deck.backend.BlankTape(ctx, name, Incrementer{cue})
+	tape, err := deck.backend.BlankTape(ctx, name, Incrementer{cue})
+	if err != nil {
+		return nil, err
+	}
+	tape.ctx, tape.name, tape.driver = ctx, name, deck.driver
+	tape.next = cue
+	tape.seek = func(cue time.Time) (TapeRecorder, error) {
+		t, err := deck.backend.BlankTape(ctx, name, Incrementer{cue})
+		if err != nil {
+			return nil, err
+		}
+		return t.tape, nil
+	}
+	return tape, nil
 }
 
 func (deck *TapeDeck) RecordedTape(ctx context.Context, name string, cue time.Time) (*RecordedTape, error) {
-	return deck.backend.RecordedTape(ctx, name, Incrementer{cue})
+	tape, err := deck.backend.RecordedTape(ctx, name, Incrementer{cue})
+	if err != nil {
+		return nil, err
+	}
+	tape.ctx, tape.name, tape.driver = ctx, name, deck.driver
+	tape.next = cue
+	return tape, nil
+}
+
+// Coverage returns the recorded ranges and the gaps between them
+// for a station from from until to
+func (deck *TapeDeck) Coverage(ctx context.Context, name string, from, to time.Time) (*Coverage, error) {
+	from = from.Truncate(time.Second * ChunkSeconds)
+	chunks, err := deck.backend.ListChunks(ctx, name, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return NewCoverage(chunks, from, to), nil
+}
+
+// A TimeRange runs from From until To
+type TimeRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// Coverage describes which times a station's tape holds
+type Coverage struct {
+	From     time.Time   `json:"from"`
+	To       time.Time   `json:"to"`
+	Recorded []TimeRange `json:"recorded"`
+	Gaps     []TimeRange `json:"gaps"`
+}
+
+// NewCoverage joins consecutive chunks, starting at the given
+// times, into recorded ranges and finds the gaps between them
+func NewCoverage(chunks []time.Time, from, to time.Time) *Coverage {
+	c := &Coverage{
+		From:     from,
+		To:       to,
+		Recorded: []TimeRange{},
+		Gaps:     []TimeRange{},
+	}
+
+	chunk := time.Second * ChunkSeconds
+	for _, t := range chunks {
+		n := len(c.Recorded)
+		if n > 0 && !t.After(c.Recorded[n-1].To) {
+			if end := t.Add(chunk); end.After(c.Recorded[n-1].To) {
+				c.Recorded[n-1].To = end
+			}
+			continue
+		}
+		c.Recorded = append(c.Recorded, TimeRange{t, t.Add(chunk)})
+	}
+
+	cue := from
+	for _, r := range c.Recorded {
+		if r.From.After(cue) {
+			c.Gaps = append(c.Gaps, TimeRange{cue, r.From})
+		}
+		cue = r.To
+	}
+	if to.After(cue) {
+		c.Gaps = append(c.Gaps, TimeRange{cue, to})
+	}
+	return c
+}
+
+// chunkTime parses the time from a chunk key
+func chunkTime(key string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339, key)
+	return t, err == nil
 }
 
 // Incrementer increments time
@@ -27,16 +122,227 @@ type Incrementer struct {
 	t time.Time
 }
 
-// TODO: use format that doesn't include offset?
+// Key returns the canonical key for the current time and
+// increments it. Keys are always UTC, so they don't change form
+// across daylight savings transitions or between backends
 func (i *Incrementer) Key() string {
-	ts := i.t.Format(time.RFC3339)
+	ts := i.t.UTC().Format(time.RFC3339)
 	i.t = i.t.Add(time.Duration(time.Second * ChunkSeconds))
 	return ts
 }
 
+// CanonicalKey rewrites a stored key ending in an RFC3339
+// timestamp with the canonical UTC form of that timestamp.
+// It returns false if the key is already canonical
+func CanonicalKey(key string) (string, bool, error) {
+	// timestamps with a zone offset are longer than those in UTC
+	for _, n := range []int{len(time.RFC3339), len("2006-01-02T15:04:05Z")} {
+		if len(key) < n {
+			continue
+		}
+		prefix, ts := key[:len(key)-n], key[len(key)-n:]
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			continue
+		}
+		canonical := t.UTC().Format(time.RFC3339)
+		return prefix + canonical, canonical != ts, nil
+	}
+	return key, false, fmt.Errorf("no timestamp in key %q", key)
+}
+
+// A KeyMigrator rewrites chunk keys written by older versions in
+// their canonical form, and returns how many were rewritten and how
+// many collided with a chunk already recorded under the canonical
+// key. Colliding chunks are left where they are
+type KeyMigrator interface {
+	MigrateKeys(ctx context.Context, dryrun bool) (migrated, collided int, err error)
+}
+
+// A ChunkDeleter deletes a station's chunk at cue and its metadata
+type ChunkDeleter interface {
+	DeleteChunk(ctx context.Context, name string, cue time.Time) error
+}
+
+// A Sweeper deletes chunks that a backend doesn't expire on its
+// own once they are older than its retention, and returns how
+// many were deleted
+type Sweeper interface {
+	Sweep(ctx context.Context, now time.Time) (int, error)
+}
+
+// RunSweeper sweeps every interval until stop closes
+func RunSweeper(stop <-chan struct{}, s Sweeper, interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := s.Sweep(ctx, time.Now())
+		if err != nil && ctx.Err() == nil {
+			level.Warn(logger).Log(
+				"msg", "error sweeping expired chunks",
+				"swept", n,
+				"err", err)
+		} else if n > 0 {
+			level.Info(logger).Log(
+				"msg", "Swept expired chunks",
+				"swept", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CopyChunk copies a station's chunk at cue and its metadata from
+// one backend to another, refusing chunks that fail their checksum
+func CopyChunk(ctx context.Context, from, to TapeBackend, name string, cue time.Time) error {
+	recorded, err := from.RecordedTape(ctx, name, Incrementer{cue})
+	if err != nil {
+		return err
+	}
+	data, meta, err := recorded.tape.Read(ctx)
+	if err != nil {
+		return err
+	}
+	if err := meta.Verify(data); err != nil {
+		return err
+	}
+	if meta == nil {
+		m := NewChunkMeta(data, false)
+		meta = &m
+	}
+
+	blank, err := to.BlankTape(ctx, name, Incrementer{cue})
+	if err != nil {
+		return err
+	}
+	return blank.tape.Write(ctx, data, *meta)
+}
+
+// An OpPolicy bounds each tape operation on a backend with
+// a deadline, and retries operations that fail transiently
+type OpPolicy struct {
+	Timeout time.Duration
+	Retries int
+	Backoff time.Duration
+}
+
+// DefaultOpPolicies are the policies for each storage driver
+var DefaultOpPolicies = map[string]OpPolicy{
+	"redis":     {Timeout: 2 * time.Second, Retries: 2, Backoff: 100 * time.Millisecond},
+	"ssdb":      {Timeout: 2 * time.Second, Retries: 2, Backoff: 100 * time.Millisecond},
+	"etcd":      {Timeout: 5 * time.Second, Retries: 2, Backoff: 250 * time.Millisecond},
+	"gcs":       {Timeout: 10 * time.Second, Retries: 3, Backoff: 500 * time.Millisecond},
+	"datastore": {Timeout: 5 * time.Second, Retries: 2, Backoff: 250 * time.Millisecond},
+}
+
+// A permanentError is not worth retrying
+type permanentError struct {
+	error
+}
+
+// Permanent marks an error, such as a missing chunk, as not worth retrying
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// Do runs op with a deadline, retrying it until it succeeds, fails
+// permanently, runs out of retries or the context is done. The op
+// is abandoned at the deadline even if its client ignores the
+// context, so it hands what it reads to its caller through keep
+func (p OpPolicy) Do(ctx context.Context, op func(ctx context.Context) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := p.attempt(ctx, op)
+		if pe, ok := err.(permanentError); ok {
+			return pe.error
+		}
+		if err == nil || ctx.Err() != nil || attempt >= p.Retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(p.Backoff << uint(attempt)):
+		}
+	}
+}
+
+// An opAttempt is one run of an op, abandoned at its deadline
+type opAttempt struct {
+	mu        sync.Mutex
+	abandoned bool
+}
+
+type opAttemptKey struct{}
+
+func (p OpPolicy) attempt(ctx context.Context, op func(ctx context.Context) error) error {
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	a := &opAttempt{}
+	ctx = context.WithValue(ctx, opAttemptKey{}, a)
+	done := make(chan error, 1)
+	go func() {
+		done <- op(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		a.mu.Lock()
+		a.abandoned = true
+		a.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// keep runs set, which stores an op's results where its caller
+// reads them, unless Do has abandoned the op
+func keep(ctx context.Context, set func()) error {
+	a, ok := ctx.Value(opAttemptKey{}).(*opAttempt)
+	if !ok {
+		set()
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.abandoned {
+		return ctx.Err()
+	}
+	set()
+	return nil
+}
+
 type TapeBackend interface {
 	BlankTape(ctx context.Context, name string, i Incrementer) (*BlankTape, error)
 	RecordedTape(ctx context.Context, name string, i Incrementer) (*RecordedTape, error)
+
+	// ListChunks returns the start times, in order, of the
+	// station's stored chunks starting from from until to
+	ListChunks(ctx context.Context, name string, from, to time.Time) ([]time.Time, error)
 }
 
 // A RecordedTape plays chunks from the datastore via the Reader interface
@@ -44,6 +350,33 @@ type TapeBackend interface {
 // and frequency and start time and backend
 type RecordedTape struct {
 	tape TapePlayer
+
+	// set by the TapeDeck to trace and measure reads
+	ctx    context.Context
+	name   string
+	driver string
+	next   time.Time
+}
+
+// Read the next chunk from the tape
+func (tape *RecordedTape) Read() (data []byte, err error) {
+	ctx, span := startTapeSpan(tape.ctx, "RecordedTape.Read", tape.name, tape.driver, tape.next)
+	start := time.Now()
+	defer func() {
+		metricChunkRead.Observe(time.Since(start).Seconds(), tape.driver)
+		endSpan(span, err)
+	}()
+
+	tape.next = tape.next.Add(time.Second * ChunkSeconds)
+	data, meta, err := tape.tape.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = meta.Verify(data); err != nil {
+		metricChecksumFailures.Add(1, tape.name)
+		return nil, err
+	}
+	return data, nil
 }
 
 // A BlankTape writes data to the datastore via the Writer interface
@@ -51,23 +384,87 @@ type RecordedTape struct {
 // and start time and backend
 type BlankTape struct {
 	tape TapeRecorder
+	next time.Time
+	seek func(cue time.Time) (TapeRecorder, error)
+
+	// set by the TapeDeck to trace writes
+	ctx    context.Context
+	name   string
+	driver string
 }
 
 // Writer interface
-func (tape BlankTape) Write(p []byte) (n int, err error) {
-	if err = tape.tape.Write(p); err != nil {
+func (tape *BlankTape) Write(p []byte) (n int, err error) {
+	if err = tape.write(p, false); err != nil {
 		return
 	}
 	n = len(p)
 	return
 }
 
-// TapePlayer exposes a simple interface to read a chunk
+// write a chunk and its metadata at the tape's cue and advance it
+func (tape *BlankTape) write(p []byte, synthetic bool) (err error) {
+	ctx, span := startTapeSpan(tape.ctx, "BlankTape.Write", tape.name, tape.driver, tape.next)
+	defer func() { endSpan(span, err) }()
+
+	if err = tape.tape.Write(ctx, p, NewChunkMeta(p, synthetic)); err != nil {
+		return
+	}
+	tape.next = tape.next.Add(time.Second * ChunkSeconds)
+	return
+}
+
+// Next returns the time of the next chunk to be written
+func (tape *BlankTape) Next() time.Time {
+	return tape.next
+}
+
+// Drift returns how far t, the time the last chunk was
+// received, is ahead of the tape's cue for the end of that chunk
+func (tape *BlankTape) Drift(t time.Time) time.Duration {
+	return t.Sub(tape.next)
+}
+
+// Seek moves the tape so the next chunk is written at cue
+func (tape *BlankTape) Seek(cue time.Time) error {
+	if tape.seek == nil {
+		return errors.New("tape cannot seek")
+	}
+	t, err := tape.seek(cue)
+	if err != nil {
+		return err
+	}
+	tape.tape = t
+	tape.next = cue
+	return nil
+}
+
+// Fill writes synthetic silent chunks for the stream
+// until the tape reaches the cue, and returns the number
+// of chunks written
+func (tape *BlankTape) Fill(cue time.Time, s *Stream) (int, error) {
+	chunk, err := SilentChunk(s.Bitrate, s.Chunksize())
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for tape.next.Before(cue) {
+		if err := tape.write(chunk, true); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// TapePlayer exposes a simple interface to read a chunk and
+// its metadata, which is nil for chunks recorded without it
 type TapePlayer interface {
-	Read() ([]byte, error)
+	Read(ctx context.Context) ([]byte, *ChunkMeta, error)
 }
 
 // TapeRecorder exposes a simple interface to write a chunk
 type TapeRecorder interface {
-	Write(data []byte) error
+	Write(ctx context.Context, data []byte, meta ChunkMeta) error
 }
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -19,4 +23,259 @@ func TestIncrementer(t *testing.T) {
 	if str != "2017-07-30T10:13:20Z" {
 		t.Errorf("Incrementer Key() failed: got %s", str)
 	}
+
+	loc, _ := time.LoadLocation("America/New_York")
+	i = Incrementer{it.In(loc)}
+	str = i.Key()
+	if str != "2017-07-30T10:13:00Z" {
+		t.Errorf("Incrementer Key() not in UTC: got %s", str)
+	}
+}
+
+func TestCanonicalKey(t *testing.T) {
+	cts := []struct {
+		key       string
+		canonical string
+		changed   bool
+		valid     bool
+	}{
+		{"chunk:wamc:2017-07-30T06:13:00-04:00", "chunk:wamc:2017-07-30T10:13:00Z", true, true},
+		{"chunk:wamc:2017-07-30T10:13:00Z", "chunk:wamc:2017-07-30T10:13:00Z", false, true},
+		{"/chunk/wamc/2017-11-05T01:30:00-05:00", "/chunk/wamc/2017-11-05T06:30:00Z", true, true},
+		{"wamc/2017-07-30T15:43:00+05:30", "wamc/2017-07-30T10:13:00Z", true, true},
+		{"chunk:wamc:yesterday", "", false, false},
+	}
+
+	for _, ct := range cts {
+		canonical, changed, err := CanonicalKey(ct.key)
+		if !ct.valid {
+			if err == nil {
+				t.Errorf("expected failure for key %q", ct.key)
+			}
+			continue
+		}
+		if err != nil || canonical != ct.canonical || changed != ct.changed {
+			t.Errorf("CanonicalKey(%q) = %q, %v, %v", ct.key, canonical, changed, err)
+		}
+	}
+}
+
+type testTapeRecorder struct {
+	chunks int
+	silent int
+}
+
+func (r *testTapeRecorder) Write(ctx context.Context, data []byte, meta ChunkMeta) error {
+	r.chunks += 1
+	if meta.Synthetic {
+		r.silent += 1
+	}
+	return nil
+}
+
+func TestBlankTapeFill(t *testing.T) {
+	rec := &testTapeRecorder{}
+	cue := time.Date(2017, 7, 30, 10, 13, 0, 0, time.UTC)
+	tape := &BlankTape{tape: rec, next: cue}
+
+	if _, err := tape.Write([]byte{}); err != nil {
+		t.Fatalf("BlankTape Write() failed: %v", err)
+	}
+
+	n, err := tape.Fill(cue.Add(time.Minute), &Stream{Bitrate: 64000})
+	if err != nil {
+		t.Fatalf("BlankTape Fill() failed: %v", err)
+	}
+	if n != 2 || rec.chunks != 3 || rec.silent != 2 {
+		t.Errorf("BlankTape Fill() wrote %d chunks, %d silent", rec.chunks, rec.silent)
+	}
+	if !tape.Next().Equal(cue.Add(time.Minute)) {
+		t.Errorf("BlankTape Next() wrong: got %s", tape.Next())
+	}
+}
+
+func TestChunkMeta(t *testing.T) {
+	chunk, err := SilentChunk(64000, 160000)
+	if err != nil {
+		t.Fatalf("SilentChunk() failed: %v", err)
+	}
+
+	meta := NewChunkMeta(chunk, true)
+	if meta.Codec != "mp3" || meta.Bitrate != 64000 || meta.SampleRate != 44100 || meta.Frames == 0 {
+		t.Errorf("NewChunkMeta() read wrong format: %+v", meta)
+	}
+	if meta.Length != len(chunk) || !meta.Synthetic || meta.Recorder != RecorderID {
+		t.Errorf("NewChunkMeta() wrong: %+v", meta)
+	}
+
+	m, err := ChunkMetaFromFields(meta.Fields())
+	if err != nil || m == nil || *m != meta {
+		t.Errorf("ChunkMetaFromFields() = %+v, %v, expected %+v", m, err, meta)
+	}
+	if m, err := ChunkMetaFromFields(map[string]string{"synthetic": "true"}); m != nil || err != nil {
+		t.Errorf("ChunkMetaFromFields() without a checksum = %+v, %v", m, err)
+	}
+
+	if err := m.Verify(chunk); err != nil {
+		t.Errorf("Verify() failed: %v", err)
+	}
+	chunk[100] ^= 0xFF
+	if err := m.Verify(chunk); err != errChunkCorrupt {
+		t.Errorf("Verify() passed a corrupt chunk: %v", err)
+	}
+	if err := (*ChunkMeta)(nil).Verify(chunk); err != nil {
+		t.Errorf("Verify() without metadata failed: %v", err)
+	}
+}
+
+type testTapeBackend struct {
+	rec    *testTapeRecorder
+	cue    time.Time
+	chunks []time.Time
+}
+
+func (b *testTapeBackend) BlankTape(ctx context.Context, name string, i Incrementer) (*BlankTape, error) {
+	b.cue = i.t
+	return &BlankTape{tape: b.rec}, nil
+}
+
+func (b *testTapeBackend) RecordedTape(ctx context.Context, name string, i Incrementer) (*RecordedTape, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (b *testTapeBackend) ListChunks(ctx context.Context, name string, from, to time.Time) (chunks []time.Time, err error) {
+	for _, c := range b.chunks {
+		if !c.Before(from) && c.Before(to) {
+			chunks = append(chunks, c)
+		}
+	}
+	return
+}
+
+func TestBlankTapeSeek(t *testing.T) {
+	b := &testTapeBackend{rec: &testTapeRecorder{}}
+	deck := &TapeDeck{backend: b}
+	cue := time.Date(2017, 7, 30, 10, 13, 0, 0, time.UTC)
+
+	tape, err := deck.BlankTape(context.Background(), "wkrp", cue)
+	if err != nil {
+		t.Fatalf("TapeDeck BlankTape() failed: %v", err)
+	}
+	tape.Write([]byte{})
+
+	if d := tape.Drift(cue.Add(time.Minute)); d != 40*time.Second {
+		t.Errorf("BlankTape Drift() wrong: got %s", d)
+	}
+
+	later := cue.Add(time.Hour)
+	if err := tape.Seek(later); err != nil {
+		t.Fatalf("BlankTape Seek() failed: %v", err)
+	}
+	if !b.cue.Equal(later) || !tape.Next().Equal(later) {
+		t.Errorf("BlankTape Seek() didn't move the tape: got %s", tape.Next())
+	}
+}
+
+func TestOpPolicy(t *testing.T) {
+	p := OpPolicy{Timeout: 10 * time.Millisecond, Retries: 2, Backoff: time.Millisecond}
+
+	// transient errors are retried
+	calls := 0
+	var data []byte
+	err := p.Do(context.Background(), func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.New("transient")
+		}
+		return keep(ctx, func() { data = []byte("chunk") })
+	})
+	if err != nil || string(data) != "chunk" || calls != 3 {
+		t.Errorf("retry failed. got %q after %d calls: %v", data, calls, err)
+	}
+
+	// permanent errors are not
+	calls = 0
+	missing := errors.New("missing")
+	err = p.Do(context.Background(), func(ctx context.Context) error {
+		calls++
+		return Permanent(missing)
+	})
+	if err != missing || calls != 1 {
+		t.Errorf("permanent error retried. got %d calls: %v", calls, err)
+	}
+
+	// ops that ignore their deadline are abandoned
+	block := make(chan struct{})
+	defer close(block)
+	var blocked int32
+	err = p.Do(context.Background(), func(ctx context.Context) error {
+		atomic.AddInt32(&blocked, 1)
+		<-block
+		return nil
+	})
+	if n := atomic.LoadInt32(&blocked); err != context.DeadlineExceeded || n != 3 {
+		t.Errorf("deadline not enforced. got %d calls: %v", n, err)
+	}
+
+	// and cannot hand back results once abandoned
+	release := make(chan struct{})
+	kept := make(chan error, 1)
+	result := "none"
+	err = OpPolicy{Timeout: time.Millisecond}.Do(context.Background(), func(ctx context.Context) error {
+		<-release
+		err := keep(ctx, func() { result = "late" })
+		kept <- err
+		return err
+	})
+	close(release)
+	if err2 := <-kept; err != context.DeadlineExceeded || err2 == nil || result != "none" {
+		t.Errorf("abandoned op kept %q: %v %v", result, err, err2)
+	}
+
+	// nothing is retried once the caller is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Do(ctx, func(ctx context.Context) error {
+		return errors.New("transient")
+	}); err == nil {
+		t.Errorf("canceled op succeeded")
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	at := func(hhmmss string) time.Time {
+		t, _ := time.Parse(time.RFC3339, "2017-07-30T"+hhmmss+"Z")
+		return t
+	}
+	chunks := []time.Time{
+		at("03:00:00"), at("03:00:20"), at("03:00:40"),
+		at("04:10:00"),
+		at("04:10:20"), // duplicate chunks are harmless
+		at("04:10:20"),
+	}
+
+	c := NewCoverage(chunks, at("02:00:00"), at("05:00:00"))
+	recorded := []TimeRange{
+		{at("03:00:00"), at("03:01:00")},
+		{at("04:10:00"), at("04:10:40")},
+	}
+	gaps := []TimeRange{
+		{at("02:00:00"), at("03:00:00")},
+		{at("03:01:00"), at("04:10:00")},
+		{at("04:10:40"), at("05:00:00")},
+	}
+	if !reflect.DeepEqual(c.Recorded, recorded) {
+		t.Errorf("recorded ranges wrong. expected %v, got %v", recorded, c.Recorded)
+	}
+	if !reflect.DeepEqual(c.Gaps, gaps) {
+		t.Errorf("gaps wrong. expected %v, got %v", gaps, c.Gaps)
+	}
+
+	// a full tape has no gaps, an empty one is all gap
+	if c := NewCoverage(chunks[:3], at("03:00:00"), at("03:01:00")); len(c.Gaps) != 0 {
+		t.Errorf("expected no gaps, got %v", c.Gaps)
+	}
+	if c := NewCoverage(nil, at("03:00:00"), at("03:01:00")); len(c.Recorded) != 0 || len(c.Gaps) != 1 {
+		t.Errorf("expected a single gap, got %+v", c)
+	}
 }
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// A TieredTapeBackend records to a fast hot tier, and moves chunks
+// older than a threshold to a cheaper cold tier, which keeps them
+// for its own retention. Recorded tapes play each chunk from the
+// tier it should be in by its age, falling through to the other
+type TieredTapeBackend struct {
+	hot, cold TapeBackend
+	after     time.Duration
+	interval  time.Duration
+	now       func() time.Time
+
+	// moved is the cue after the last chunk moved for each station,
+	// only touched by the mover
+	moved map[string]time.Time
+}
+
+// NewTieredTapeBackend moves chunks from hot to cold once they
+// are older than after, checking for them every interval
+func NewTieredTapeBackend(hot, cold TapeBackend, after, interval time.Duration) *TieredTapeBackend {
+	return &TieredTapeBackend{
+		hot:      hot,
+		cold:     cold,
+		after:    after,
+		interval: interval,
+		now:      time.Now,
+		moved:    map[string]time.Time{},
+	}
+}
+
+// Implements Backend, the tiers are initialized on their own
+func (b *TieredTapeBackend) Init() error {
+	return nil
+}
+
+// Implements Pinger
+func (b *TieredTapeBackend) Ping(ctx context.Context) error {
+	if err := ping(ctx, b.hot); err != nil {
+		return err
+	}
+	return ping(ctx, b.cold)
+}
+
+// Implements BlankTape
+func (b *TieredTapeBackend) BlankTape(ctx context.Context, name string, i Incrementer) (*BlankTape, error) {
+	return b.hot.BlankTape(ctx, name, i)
+}
+
+// Implements RecordedTape
+func (b *TieredTapeBackend) RecordedTape(ctx context.Context, name string, i Incrementer) (*RecordedTape, error) {
+	return &RecordedTape{
+		tape: &TieredTape{
+			name: name,
+			i:    i,
+			b:    b,
+		},
+	}, nil
+}
+
+// Implements TapeBackend
+func (b *TieredTapeBackend) ListChunks(ctx context.Context, name string, from, to time.Time) ([]time.Time, error) {
+	hot, err := b.hot.ListChunks(ctx, name, from, to)
+	if err != nil {
+		return nil, err
+	}
+	cold, err := b.cold.ListChunks(ctx, name, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// chunks are in both tiers until they are deleted from the hot one
+	seen := map[int64]bool{}
+	var chunks []time.Time
+	for _, t := range append(hot, cold...) {
+		if !seen[t.Unix()] {
+			seen[t.Unix()] = true
+			chunks = append(chunks, t)
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Before(chunks[j]) })
+	return chunks, nil
+}
+
+// Implements KeyMigrator
+func (b *TieredTapeBackend) MigrateKeys(ctx context.Context, dryrun bool) (n, collided int, err error) {
+	for _, tier := range []TapeBackend{b.hot, b.cold} {
+		m, ok := tier.(KeyMigrator)
+		if !ok {
+			continue
+		}
+		migrated, c, err := m.MigrateKeys(ctx, dryrun)
+		n, collided = n+migrated, collided+c
+		if err != nil {
+			return n, collided, err
+		}
+	}
+	return n, collided, nil
+}
+
+// Implements Sweeper
+func (b *TieredTapeBackend) Sweep(ctx context.Context, now time.Time) (int, error) {
+	n := 0
+	for _, tier := range []TapeBackend{b.hot, b.cold} {
+		s, ok := tier.(Sweeper)
+		if !ok {
+			continue
+		}
+		swept, err := s.Sweep(ctx, now)
+		n += swept
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Run moves chunks for the stations every interval until stop closes
+func (b *TieredTapeBackend) Run(stop <-chan struct{}, stations func() ([]Station, error)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		ss, err := stations()
+		if err != nil {
+			level.Warn(logger).Log(
+				"msg", "error loading stations to move",
+				"err", err)
+		}
+		for _, s := range ss {
+			n, err := b.Move(ctx, s.Name, time.Now())
+			if err != nil && ctx.Err() == nil {
+				level.Warn(logger).Log(
+					"msg", "error moving chunks to the cold tier",
+					"station", s.Name,
+					"moved", n,
+					"err", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Move copies a station's chunks that are older than the threshold
+// at now from the hot tier to the cold tier, and returns how many
+// were moved. Once their copy reads back intact, chunks are deleted
+// from a hot tier that can delete them, and otherwise expire
+func (b *TieredTapeBackend) Move(ctx context.Context, name string, now time.Time) (int, error) {
+	from := now.Add(-TTL).Truncate(time.Second * ChunkSeconds)
+	if moved := b.moved[name]; moved.After(from) {
+		from = moved
+	}
+	to := now.Add(-b.after).Truncate(time.Second * ChunkSeconds)
+	if !to.After(from) {
+		return 0, nil
+	}
+
+	hot, err := b.hot.ListChunks(ctx, name, from, to)
+	if err != nil {
+		return 0, err
+	}
+	cold, err := b.cold.ListChunks(ctx, name, from, to)
+	if err != nil {
+		return 0, err
+	}
+	copied := map[int64]bool{}
+	for _, t := range cold {
+		copied[t.Unix()] = true
+	}
+
+	deleter, _ := b.hot.(ChunkDeleter)
+	n := 0
+	for _, t := range hot {
+		if !copied[t.Unix()] {
+			if err := CopyChunk(ctx, b.hot, b.cold, name, t); err != nil {
+				return n, err
+			}
+			metricChunksMoved.Add(1, name)
+			n++
+		}
+		if deleter == nil {
+			continue
+		}
+
+		if err := verifyChunk(ctx, b.cold, name, t); err != nil {
+			return n, err
+		}
+		if err := deleter.DeleteChunk(ctx, name, t); err != nil {
+			return n, err
+		}
+	}
+	b.moved[name] = to
+	return n, nil
+}
+
+// verifyChunk reads back a station's chunk at cue and checks it
+// against its checksum
+func verifyChunk(ctx context.Context, tier TapeBackend, name string, cue time.Time) error {
+	recorded, err := tier.RecordedTape(ctx, name, Incrementer{cue})
+	if err != nil {
+		return err
+	}
+	data, meta, err := recorded.tape.Read(ctx)
+	if err != nil {
+		return err
+	}
+	return meta.Verify(data)
+}
+
+// A TieredTape plays each chunk from the tier it should be in by
+// its age, or from the other tier if that tier can't play it
+type TieredTape struct {
+	name string
+	i    Incrementer
+	b    *TieredTapeBackend
+}
+
+func (t *TieredTape) Read(ctx context.Context) ([]byte, *ChunkMeta, error) {
+	cue := t.i.t
+	t.i.Key()
+
+	// chunks are moved once they are older than after,
+	// within an interval of the mover running
+	first, second := t.b.hot, t.b.cold
+	if t.b.now().Sub(cue) > t.b.after+t.b.interval {
+		first, second = second, first
+	}
+
+	// each tier's tape only plays the one chunk,
+	// so neither falls behind the other
+	if data, meta, err := t.read(ctx, first, cue); err == nil && meta.Verify(data) == nil {
+		return data, meta, nil
+	}
+	return t.read(ctx, second, cue)
+}
+
+func (t *TieredTape) read(ctx context.Context, tier TapeBackend, cue time.Time) ([]byte, *ChunkMeta, error) {
+	recorded, err := tier.RecordedTape(ctx, t.name, Incrementer{cue})
+	if err != nil {
+		return nil, nil, err
+	}
+	return recorded.tape.Read(ctx)
+}
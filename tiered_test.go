@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+)
+
+// memTapeBackend keeps chunks and their metadata in memory,
+// failing tape reads and writes with err if it is set
+type memTapeBackend struct {
+	chunks map[string][]byte
+	meta   map[string]ChunkMeta
+	err    error
+	writes int
+	reads  int
+}
+
+func newMemTapeBackend() *memTapeBackend {
+	return &memTapeBackend{chunks: map[string][]byte{}, meta: map[string]ChunkMeta{}}
+}
+
+func (b *memTapeBackend) BlankTape(ctx context.Context, name string, i Incrementer) (*BlankTape, error) {
+	return &BlankTape{tape: &memTape{b, name, i}}, nil
+}
+
+func (b *memTapeBackend) RecordedTape(ctx context.Context, name string, i Incrementer) (*RecordedTape, error) {
+	return &RecordedTape{tape: &memTape{b, name, i}}, nil
+}
+
+func (b *memTapeBackend) ListChunks(ctx context.Context, name string, from, to time.Time) ([]time.Time, error) {
+	var chunks []time.Time
+	for k := range b.chunks {
+		t, _ := chunkTime(k[len(name)+1:])
+		if k[:len(name)] == name && !t.Before(from) && t.Before(to) {
+			chunks = append(chunks, t)
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Before(chunks[j]) })
+	return chunks, nil
+}
+
+func (b *memTapeBackend) DeleteChunk(ctx context.Context, name string, cue time.Time) error {
+	k := name + "/" + cue.UTC().Format(time.RFC3339)
+	delete(b.chunks, k)
+	delete(b.meta, k)
+	return nil
+}
+
+type memTape struct {
+	b    *memTapeBackend
+	name string
+	i    Incrementer
+}
+
+func (t *memTape) Write(ctx context.Context, data []byte, meta ChunkMeta) error {
+	t.b.writes++
+	if t.b.err != nil {
+		return t.b.err
+	}
+	k := t.name + "/" + t.i.Key()
+	t.b.chunks[k], t.b.meta[k] = data, meta
+	return nil
+}
+
+func (t *memTape) Read(ctx context.Context) ([]byte, *ChunkMeta, error) {
+	t.b.reads++
+	if t.b.err != nil {
+		return nil, nil, t.b.err
+	}
+	k := t.name + "/" + t.i.Key()
+	data, ok := t.b.chunks[k]
+	if !ok {
+		return nil, nil, errors.New("no chunk")
+	}
+	meta := t.b.meta[k]
+	return data, &meta, nil
+}
+
+func TestTieredTapeBackend(t *testing.T) {
+	hot, cold := newMemTapeBackend(), newMemTapeBackend()
+	b := NewTieredTapeBackend(hot, cold, time.Hour, time.Minute)
+	ctx := context.Background()
+	cue := time.Date(2017, 7, 30, 10, 0, 0, 0, time.UTC)
+
+	blank, _ := b.BlankTape(ctx, "wamc", Incrementer{cue})
+	for i := 0; i < 3; i++ {
+		if err := blank.write(data, i == 2); err != nil {
+			t.Fatalf("BlankTape write failed: %v", err)
+		}
+	}
+	if len(hot.chunks) != 3 || len(cold.chunks) != 0 {
+		t.Fatalf("chunks not written to the hot tier: %d hot, %d cold", len(hot.chunks), len(cold.chunks))
+	}
+
+	// only chunks older than an hour move
+	n, err := b.Move(ctx, "wamc", cue.Add(time.Hour+40*time.Second))
+	if err != nil || n != 2 {
+		t.Fatalf("Move() = %d, %v, expected 2 chunks", n, err)
+	}
+	n, err = b.Move(ctx, "wamc", cue.Add(2*time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("Move() = %d, %v, expected 1 chunk", n, err)
+	}
+	if m := cold.meta["wamc/2017-07-30T10:00:40Z"]; !m.Synthetic || m.Length != len(data) {
+		t.Errorf("chunk metadata not moved: %+v", m)
+	}
+	if len(hot.chunks) != 0 || len(hot.meta) != 0 {
+		t.Errorf("moved chunks not deleted from the hot tier: %v", hot.chunks)
+	}
+
+	// old chunks play from the cold tier
+	b.now = func() time.Time { return cue.Add(2 * time.Hour) }
+	hot.reads, cold.reads = 0, 0
+	tape, _ := b.RecordedTape(ctx, "wamc", Incrementer{cue})
+	for i := 0; i < 3; i++ {
+		d, err := tape.Read()
+		if err != nil || !bytes.Equal(d, data) {
+			t.Errorf("chunk %d not played: %q, %v", i, d, err)
+		}
+	}
+	if hot.reads != 0 || cold.reads != 3 {
+		t.Errorf("expected 3 cold reads, got %d hot and %d cold", hot.reads, cold.reads)
+	}
+	if _, err := tape.Read(); err == nil {
+		t.Errorf("played a chunk that was never recorded")
+	}
+
+	// young chunks play from the hot tier, falling through to the
+	// cold tier, and corrupt chunks fall through to the other tier
+	b.now = func() time.Time { return cue.Add(10 * time.Minute) }
+	hot.chunks["wamc/2017-07-30T10:00:20Z"] = []byte("static")
+	hot.meta["wamc/2017-07-30T10:00:20Z"] = cold.meta["wamc/2017-07-30T10:00:20Z"]
+	hot.reads, cold.reads = 0, 0
+	tape, _ = b.RecordedTape(ctx, "wamc", Incrementer{cue})
+	for i := 0; i < 3; i++ {
+		d, err := tape.Read()
+		if err != nil || !bytes.Equal(d, data) {
+			t.Errorf("chunk %d not played: %q, %v", i, d, err)
+		}
+	}
+	if hot.reads != 3 || cold.reads != 3 {
+		t.Errorf("expected 3 hot and 3 cold reads, got %d and %d", hot.reads, cold.reads)
+	}
+
+	chunks, err := b.ListChunks(ctx, "wamc", cue, cue.Add(time.Hour))
+	if err != nil || len(chunks) != 3 {
+		t.Errorf("ListChunks() = %v, %v, expected 3 chunks", chunks, err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"go.opencensus.io/trace"
+)
+
+// ConfigureTracing registers the named span exporter and
+// samples the given fraction of traces
+func ConfigureTracing(exporter string, fraction float64) error {
+	switch exporter {
+	case "", "none":
+		return nil
+	case "log":
+		trace.RegisterExporter(logExporter{})
+	case "stdout":
+		trace.RegisterExporter(&jsonExporter{enc: json.NewEncoder(os.Stdout)})
+	default:
+		return fmt.Errorf("no %q trace exporter found", exporter)
+	}
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(fraction)})
+	return nil
+}
+
+// logExporter writes finished spans to the logger
+type logExporter struct{}
+
+func (logExporter) ExportSpan(s *trace.SpanData) {
+	kv := []interface{}{
+		"msg", "span",
+		"name", s.Name,
+		"trace", s.TraceID.String(),
+		"span", s.SpanID.String(),
+		"parent", s.ParentSpanID.String(),
+		"duration", s.EndTime.Sub(s.StartTime),
+	}
+	for k, v := range s.Attributes {
+		kv = append(kv, k, v)
+	}
+	if s.Code != trace.StatusCodeOK {
+		kv = append(kv, "err", s.Message)
+	}
+	level.Info(logger).Log(kv...)
+}
+
+// jsonExporter writes finished spans to stdout, one per line.
+// Spans end on many goroutines, so the encoder is locked
+type jsonExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (e *jsonExporter) ExportSpan(s *trace.SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.enc.Encode(s)
+}
+
+// startTapeSpan starts a span for an operation on a station's tape
+func startTapeSpan(ctx context.Context, op, name, driver string, cue time.Time) (context.Context, *trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := trace.StartSpan(ctx, op)
+	span.AddAttributes(
+		trace.StringAttribute("station", name),
+		trace.StringAttribute("key", cue.UTC().Format(time.RFC3339)),
+		trace.StringAttribute("driver", driver))
+	return ctx, span
+}
+
+// endSpan ends a span, marking it failed if err is set
+func endSpan(span *trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	span.End()
+}
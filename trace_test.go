@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+type testExporter struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (e *testExporter) ExportSpan(s *trace.SpanData) {
+	e.mu.Lock()
+	e.spans = append(e.spans, s)
+	e.mu.Unlock()
+}
+
+func TestTapeSpans(t *testing.T) {
+	e := &testExporter{}
+	trace.RegisterExporter(e)
+	defer trace.UnregisterExporter(e)
+
+	b := &testTapeBackend{rec: &testTapeRecorder{}}
+	deck := &TapeDeck{backend: b, driver: "test"}
+	cue := time.Date(2017, 7, 30, 10, 13, 0, 0, time.UTC)
+
+	ctx, parent := trace.StartSpan(context.Background(), "test", trace.WithSampler(trace.AlwaysSample()))
+	tape, err := deck.BlankTape(ctx, "wkrp", cue)
+	if err != nil {
+		t.Fatalf("TapeDeck BlankTape() failed: %v", err)
+	}
+	tape.Write([]byte{})
+	parent.End()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(e.spans))
+	}
+
+	s := e.spans[0]
+	if s.Name != "BlankTape.Write" || s.ParentSpanID != parent.SpanContext().SpanID {
+		t.Errorf("write span wrong: %s", s.Name)
+	}
+	for k, v := range map[string]string{
+		"station": "wkrp",
+		"key":     "2017-07-30T10:13:00Z",
+		"driver":  "test",
+	} {
+		if s.Attributes[k] != v {
+			t.Errorf("write span attribute %s wrong. expected %s, got %v", k, v, s.Attributes[k])
+		}
+	}
+}
+
+func TestJSONExporter(t *testing.T) {
+	var buf bytes.Buffer
+	e := &jsonExporter{enc: json.NewEncoder(&buf)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				e.ExportSpan(&trace.SpanData{
+					Name:       "RecordedTape.Read",
+					Attributes: map[string]interface{}{"station": "wamc"},
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	n := 0
+	lines := bufio.NewScanner(&buf)
+	for lines.Scan() {
+		var s trace.SpanData
+		if err := json.Unmarshal(lines.Bytes(), &s); err != nil || s.Name != "RecordedTape.Read" {
+			t.Fatalf("span %d garbled: %s, %v", n, lines.Bytes(), err)
+		}
+		n++
+	}
+	if n != 200 {
+		t.Errorf("exported %d spans, want 200", n)
+	}
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"errors"
+	"fmt"
 	"io"
+	"net/url"
 	"strings"
 	"time"
 
@@ -17,17 +18,53 @@ type streamPath struct {
 	listenerLocation *time.Location
 }
 
-func ParsePath(path string) (*streamPath, error) {
-	pieces := strings.Split(path, "/")
-	if len(pieces) != 3 {
-		return nil, errors.New("incorrect number of path elements")
+// A PathError explains why a listener's path was rejected
+type PathError struct {
+	Err         string   `json:"err"`
+	Zone        string   `json:"zone,omitempty"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+func (e *PathError) Error() string {
+	if e.Zone != "" {
+		return fmt.Sprintf("%s: %q", e.Err, e.Zone)
 	}
+	return e.Err
+}
 
+// ParsePath parses a path of the form {station}/{zone}, where zone
+// is an IANA zone name of any depth or a fixed offset like +05:30.
+// The zone can instead be given in the tz query parameter, or left
+// out, in which case the listener location is nil
+func ParsePath(path string, query url.Values) (*streamPath, error) {
+	pieces := strings.SplitN(path, "/", 2)
 	name := pieces[0]
-	locName := pieces[1] + "/" + pieces[2]
-	loc, err := time.LoadLocation(locName)
+	if name == "" {
+		return nil, &PathError{Err: "missing station name"}
+	}
+
+	var zone string
+	if len(pieces) == 2 {
+		zone = strings.Trim(pieces[1], "/")
+	}
+	if tz := query.Get("tz"); tz != "" {
+		if zone != "" {
+			return nil, &PathError{Err: "listener zone given in both path and query"}
+		}
+		zone = tz
+	}
+	if zone == "" {
+		// the zone may yet be inferred from the listener's address
+		return &streamPath{stationName: name}, nil
+	}
+
+	loc, err := LoadZone(zone)
 	if err != nil {
-		return nil, err
+		return nil, &PathError{
+			Err:         "unknown listener zone",
+			Zone:        zone,
+			Suggestions: SuggestZones(zone, 5),
+		}
 	}
 
 	return &streamPath{stationName: name, listenerLocation: loc}, nil
@@ -35,13 +72,89 @@ func ParsePath(path string) (*streamPath, error) {
 
 // TIME FUNCTIONS
 
-// LocationDistanceInMinutes returns the minutes relative to listener's location
-// Since we're using locations, this should even work during the weird daylight savings week
-func LocationDistanceInMinutes(t time.Time, loc, stationLoc *time.Location) int {
-	ts := t.Format(time.ANSIC)
-	locTime, _ := time.ParseInLocation(time.ANSIC, ts, loc)
-	stationTime, _ := time.ParseInLocation(time.ANSIC, ts, stationLoc)
-	return int(stationTime.Sub(locTime) / time.Minute)
+// A DSTPolicy decides which instant a station's wall clock time
+// refers to when daylight savings repeats or skips that time. Playback
+// then runs in real time, so the policy picks where a listener tuning
+// in during the repeated or skipped hour starts
+type DSTPolicy struct {
+	// RepeatTwice starts a repeated hour at its first pass, so listeners
+	// hear it twice, otherwise at its second pass, so they hear it once
+	RepeatTwice bool
+	// FillSkipped fills a skipped hour with the hour before it, so
+	// listeners catch up to the station's clock when it ends, otherwise
+	// skips it, playing the hour after it
+	FillSkipped bool
+}
+
+// ParseDSTPolicy returns the policy for a repeated hour played
+// twice|once and a skipped hour to skip|fill
+func ParseDSTPolicy(repeated, skipped string) (DSTPolicy, error) {
+	var p DSTPolicy
+	switch repeated {
+	case "twice":
+		p.RepeatTwice = true
+	case "once":
+	default:
+		return p, fmt.Errorf("repeated hour must be played twice|once, not %q", repeated)
+	}
+	switch skipped {
+	case "fill":
+		p.FillSkipped = true
+	case "skip":
+	default:
+		return p, fmt.Errorf("skipped hour must be skip|fill, not %q", skipped)
+	}
+	return p, nil
+}
+
+// WallTimeIn returns the instant at which the wall clock in loc
+// read the date and time of wall, ignoring wall's own location
+func WallTimeIn(wall time.Time, loc *time.Location, policy DSTPolicy) time.Time {
+	y, mo, d := wall.Date()
+	h, mi, s := wall.Clock()
+	utc := time.Date(y, mo, d, h, mi, s, wall.Nanosecond(), time.UTC)
+
+	// try the offsets in effect a day either side of the wall time. a time
+	// is valid in loc if its own offset is the one used to reach it:
+	// repeated times have two valid readings, skipped times none
+	var valid, all []time.Time
+	for _, side := range []time.Duration{-24 * time.Hour, 24 * time.Hour} {
+		_, offset := utc.Add(side).In(loc).Zone()
+		t := utc.Add(-time.Duration(offset) * time.Second).In(loc)
+		all = append(all, t)
+		if _, o := t.Zone(); o == offset {
+			valid = append(valid, t)
+		}
+	}
+
+	// the earlier reading of a skipped time is in the hour before it
+	earlier := policy.RepeatTwice
+	if len(valid) == 0 {
+		valid = all
+		earlier = policy.FillSkipped
+	}
+
+	t := valid[0]
+	for _, v := range valid[1:] {
+		if earlier == v.Before(t) {
+			t = v
+		}
+	}
+	return t
+}
+
+// ListenerTimeAt returns the most recent instant before now at
+// which the station's wall clock read what the listener's reads now
+func ListenerTimeAt(now time.Time, listener, station *time.Location, policy DSTPolicy) time.Time {
+	wall := now.In(listener)
+	t := WallTimeIn(wall, station, policy)
+	if !t.Before(now) {
+		y, mo, d := wall.Date()
+		h, mi, s := wall.Clock()
+		yesterday := time.Date(y, mo, d-1, h, mi, s, wall.Nanosecond(), time.UTC)
+		t = WallTimeIn(yesterday, station, policy)
+	}
+	return t
 }
 
 // MP3 FUNCTIONS
@@ -66,6 +179,69 @@ func DetectBitrate(r io.Reader) (bps int, err error) {
 	return
 }
 
+var (
+	mpeg1Bitrates = []int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}
+	mpeg2Bitrates = []int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}
+)
+
+// SilentChunk returns size bytes of silent mono MP3 frames at
+// the given bitrate in bits per second. MPEG-1 at 44.1kHz is
+// used where the bitrate allows it, MPEG-2 at 22.05kHz otherwise.
+// Any space left over after the last whole frame is zeroed.
+func SilentChunk(bitrate, size int) ([]byte, error) {
+	var (
+		header      = []byte{0xFF, 0, 0, 0xC0} // mono, no emphasis
+		sideinfo    int
+		slotsPerBit int
+		samplerate  int
+		index       int
+	)
+
+	if index = bitrateIndex(mpeg1Bitrates, bitrate); index > 0 {
+		header[1] = 0xFB // MPEG-1 layer III, no CRC
+		sideinfo, slotsPerBit, samplerate = 17, 144, 44100
+	} else if index = bitrateIndex(mpeg2Bitrates, bitrate); index > 0 {
+		header[1] = 0xF3 // MPEG-2 layer III, no CRC
+		sideinfo, slotsPerBit, samplerate = 9, 72, 22050
+	} else {
+		return nil, fmt.Errorf("no mp3 frame encodes bitrate %d", bitrate)
+	}
+
+	// frames are slotsPerBit*bitrate/samplerate bytes long, with
+	// the padding bit set on enough frames to make up the remainder
+	framesize := slotsPerBit * bitrate / samplerate
+	remainder := slotsPerBit * bitrate % samplerate
+
+	chunk := make([]byte, size)
+	carry := 0
+	for offset := 0; ; {
+		n := framesize
+		header[2] = byte(index << 4)
+		if carry += remainder; carry >= samplerate {
+			carry -= samplerate
+			header[2] |= 0x02
+			n++
+		}
+		if offset+n > size || n < len(header)+sideinfo {
+			break
+		}
+		// an all-zero side info and main data decodes as silence
+		copy(chunk[offset:], header)
+		offset += n
+	}
+
+	return chunk, nil
+}
+
+func bitrateIndex(table []int, bitrate int) int {
+	for i, kbps := range table {
+		if i > 0 && kbps*1000 == bitrate {
+			return i
+		}
+	}
+	return 0
+}
+
 // IO FUNCTIONS
 
 // ChunkPipe pumps reads from the reader to the writer
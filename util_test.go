@@ -1,39 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
 
-func TestLocationDistanceInMinutes(t *testing.T) {
-	ots := []struct {
-		ts      string
-		src     string
-		dst     string
-		minutes int
-	}{
-		{"Sun Jul 30 10:13:25 2017", "America/New_York", "Europe/Stockholm", -360},
-		{"Sun Jul 30 10:13:25 2017", "Europe/Stockholm", "America/New_York", 360},
-		{"Sun Mar 19 10:13:25 2017", "Europe/Stockholm", "America/New_York", 300}, // US has already started DST but not Europe yet
-		{"Wed Nov 1 10:13:25 2017", "Europe/Stockholm", "America/New_York", 300},  // Europe has finished DST but US not yet
-		{"Wed Nov 1 10:13:25 2017", "America/Los_Angeles", "America/New_York", -180},
-	}
-
-	for i, ot := range ots {
-		ts, _ := time.Parse(time.ANSIC, ot.ts)
-		sloc, _ := time.LoadLocation(ot.src)
-		dloc, _ := time.LoadLocation(ot.dst)
-		d := LocationDistanceInMinutes(ts, sloc, dloc)
-		if d != ot.minutes {
-			t.Errorf("distance wrong. trial %d expected %d, got %d", i, ot.minutes, d)
-		}
-	}
-}
-
 func TestDetect(t *testing.T) {
 	dts := []struct {
 		filename string
@@ -126,3 +104,203 @@ func TestChunkPipe(t *testing.T) {
 		t.Error("ChunkPipe busted")
 	}
 }
+
+func TestSilentChunk(t *testing.T) {
+	sts := []struct {
+		bitrate int
+		valid   bool
+	}{
+		{128000, true},
+		{64000, true},
+		{24000, true},
+		{12345, false},
+	}
+
+	for _, st := range sts {
+		size := st.bitrate * ChunkSeconds / 8
+		chunk, err := SilentChunk(st.bitrate, size)
+		if !st.valid {
+			if err == nil {
+				t.Errorf("expected failure for bitrate %d", st.bitrate)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected failure for bitrate %d: %v", st.bitrate, err)
+			continue
+		}
+
+		if len(chunk) != size {
+			t.Errorf("chunk size wrong. expected %d, got %d", size, len(chunk))
+		}
+
+		bps, err := DetectBitrate(bytes.NewReader(chunk))
+		if err != nil || bps != st.bitrate {
+			t.Errorf("detected bitrate was incorrect. expected %d, got %d", st.bitrate, bps)
+		}
+	}
+}
+
+func TestListenerTimeAt(t *testing.T) {
+	lts := []struct {
+		now      string
+		listener string
+		station  string
+		hour     string // repeated|skipped at the station
+		earlier  string
+		later    string
+	}{
+		// station falls back: the first pass plays the hour twice, the second once
+		{"2017-11-05T11:30:00Z", "Pacific/Honolulu", "America/New_York", "repeated", "2017-11-05T01:30:00-04:00", "2017-11-05T01:30:00-05:00"},
+		{"2017-11-06T01:30:00Z", "Europe/London", "America/New_York", "repeated", "2017-11-05T01:30:00-04:00", "2017-11-05T01:30:00-05:00"},
+		{"2017-04-01T21:00:00Z", "Asia/Kolkata", "Australia/Sydney", "repeated", "2017-04-02T02:30:00+11:00", "2017-04-02T02:30:00+10:00"},
+		{"2017-04-01T21:15:00Z", "Asia/Kathmandu", "Pacific/Chatham", "repeated", "2017-04-02T03:00:00+13:45", "2017-04-02T03:00:00+12:45"},
+		{"2017-04-01T23:45:00Z", "Europe/Berlin", "Australia/Lord_Howe", "repeated", "2017-04-02T01:45:00+11:00", "2017-04-02T01:45:00+10:30"},
+		{"2017-10-29T05:00:00Z", "America/St_Johns", "Europe/Berlin", "repeated", "2017-10-29T02:30:00+02:00", "2017-10-29T02:30:00+01:00"},
+
+		// station springs forward: the hour before fills the skipped hour, or the hour after skips it
+		{"2017-03-12T12:30:00Z", "Pacific/Honolulu", "America/New_York", "skipped", "2017-03-12T01:30:00-05:00", "2017-03-12T03:30:00-04:00"},
+		{"2017-09-30T21:00:00Z", "Asia/Kolkata", "Australia/Sydney", "skipped", "2017-10-01T01:30:00+10:00", "2017-10-01T03:30:00+11:00"},
+		{"2017-10-01T02:15:00Z", "UTC", "Australia/Lord_Howe", "skipped", "2017-10-01T01:45:00+10:30", "2017-10-01T02:45:00+11:00"},
+		{"2017-09-23T21:15:00Z", "Asia/Kathmandu", "Pacific/Chatham", "skipped", "2017-09-24T02:00:00+12:45", "2017-09-24T04:00:00+13:45"},
+
+		// listener falls back: both passes play the same station time
+		{"2017-04-01T14:45:00Z", "Australia/Lord_Howe", "America/New_York", "", "2017-04-01T01:45:00-04:00", "2017-04-01T01:45:00-04:00"},
+		{"2017-04-01T15:15:00Z", "Australia/Lord_Howe", "America/New_York", "", "2017-04-01T01:45:00-04:00", "2017-04-01T01:45:00-04:00"},
+
+		// listener springs forward: station time jumps ahead with them
+		{"2017-03-26T00:59:40Z", "Europe/London", "Asia/Kolkata", "", "2017-03-26T00:59:40+05:30", "2017-03-26T00:59:40+05:30"},
+		{"2017-03-26T01:00:00Z", "Europe/London", "Asia/Kolkata", "", "2017-03-26T02:00:00+05:30", "2017-03-26T02:00:00+05:30"},
+
+		// no transitions
+		{"2017-07-30T14:13:00Z", "America/New_York", "America/New_York", "", "2017-07-29T10:13:00-04:00", "2017-07-29T10:13:00-04:00"},
+		{"2017-07-30T14:13:00Z", "America/Los_Angeles", "America/New_York", "", "2017-07-30T07:13:00-04:00", "2017-07-30T07:13:00-04:00"},
+		{"2017-07-30T14:13:00Z", "Europe/Stockholm", "America/New_York", "", "2017-07-29T16:13:00-04:00", "2017-07-29T16:13:00-04:00"},
+		{"2017-07-30T14:13:00Z", "America/Argentina/Buenos_Aires", "Asia/Kathmandu", "", "2017-07-30T11:13:00+05:45", "2017-07-30T11:13:00+05:45"},
+	}
+
+	for i, lt := range lts {
+		now, _ := time.Parse(time.RFC3339, lt.now)
+		lloc, err := time.LoadLocation(lt.listener)
+		if err != nil {
+			t.Fatalf("unknown location %s", lt.listener)
+		}
+		sloc, err := time.LoadLocation(lt.station)
+		if err != nil {
+			t.Fatalf("unknown location %s", lt.station)
+		}
+
+		for _, repeated := range []string{"twice", "once"} {
+			for _, skipped := range []string{"skip", "fill"} {
+				policy, err := ParseDSTPolicy(repeated, skipped)
+				if err != nil {
+					t.Fatalf("ParseDSTPolicy failed, %v", err)
+				}
+				expected := lt.later
+				if lt.hour == "repeated" && repeated == "twice" || lt.hour == "skipped" && skipped == "fill" {
+					expected = lt.earlier
+				}
+
+				st := ListenerTimeAt(now, lloc, sloc, policy)
+				if got := st.Format(time.RFC3339); got != expected {
+					t.Errorf("listener time wrong. trial %d policy %s/%s expected %s, got %s", i, repeated, skipped, expected, got)
+				}
+				if !st.Before(now) {
+					t.Errorf("listener time not in the past. trial %d policy %s/%s got %s", i, repeated, skipped, st)
+				}
+			}
+		}
+	}
+
+	for _, names := range [][2]string{{"earlier", "fill"}, {"twice", "later"}, {"", ""}} {
+		if _, err := ParseDSTPolicy(names[0], names[1]); err == nil {
+			t.Errorf("dst policy %s/%s accepted", names[0], names[1])
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	pts := []struct {
+		path   string
+		query  string
+		name   string
+		offset int
+		valid  bool
+	}{
+		{"wamc/America/New_York", "", "wamc", -4 * 60 * 60, true},
+		{"wamc/America/Argentina/Buenos_Aires", "", "wamc", -3 * 60 * 60, true},
+		{"wamc/UTC", "", "wamc", 0, true},
+		{"wamc/Etc/GMT+5", "", "wamc", -5 * 60 * 60, true},
+		{"wamc/+05:30", "", "wamc", 5*60*60 + 30*60, true},
+		{"wamc/-0800/", "", "wamc", -8 * 60 * 60, true},
+		{"wamc/UTC+5", "", "wamc", 5 * 60 * 60, true},
+		{"wamc", "tz=Asia/Kathmandu", "wamc", 5*60*60 + 45*60, true},
+		{"wamc/", "tz=+05:30", "wamc", 5*60*60 + 30*60, true},
+		{"wamc/", "tz=%2B05:30", "wamc", 5*60*60 + 30*60, true},
+		{"wamc/Europe/Stockholm", "tz=UTC", "", 0, false},
+		{"wamc/+15:00", "", "", 0, false},
+		{"wamc/Local", "", "", 0, false},
+		{"/America/New_York", "", "", 0, false},
+		{"wamc/America/New_Yrok", "", "", 0, false},
+	}
+
+	ts := time.Date(2017, 7, 30, 10, 13, 0, 0, time.UTC)
+	for i, pt := range pts {
+		query, _ := url.ParseQuery(pt.query)
+		sp, err := ParsePath(pt.path, query)
+		if !pt.valid {
+			if _, ok := err.(*PathError); !ok {
+				t.Errorf("expected path error. trial %d got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected failure. trial %d: %v", i, err)
+			continue
+		}
+
+		_, offset := ts.In(sp.listenerLocation).Zone()
+		if sp.stationName != pt.name || offset != pt.offset {
+			t.Errorf("path parsed wrong. trial %d got %s with offset %d", i, sp.stationName, offset)
+		}
+	}
+
+	// the zone is left for the radio to infer
+	for _, path := range []string{"wamc", "wamc/"} {
+		sp, err := ParsePath(path, url.Values{})
+		if err != nil || sp.stationName != "wamc" || sp.listenerLocation != nil {
+			t.Errorf("path without zone parsed wrong: %v", err)
+		}
+	}
+}
+
+func TestSuggestZones(t *testing.T) {
+	sts := []struct {
+		zone     string
+		expected string
+	}{
+		{"America/New_Yrok", "America/New_York"},
+		{"buenos aires", "America/Argentina/Buenos_Aires"},
+		{"Europe/Stokholm", "Europe/Stockholm"},
+	}
+
+	for _, st := range sts {
+		found := false
+		for _, s := range SuggestZones(st.zone, 5) {
+			found = found || s == st.expected
+		}
+		if !found {
+			t.Errorf("suggestions for %q missing %q: got %v", st.zone, st.expected, SuggestZones(st.zone, 5))
+		}
+	}
+
+	if s := SuggestZones(strings.Repeat("America/New_York", 5), 5); len(s) != 0 {
+		t.Errorf("suggestions made for a long name: %v", s)
+	}
+	// a letter is in nearly every zone
+	for _, s := range SuggestZones("e", 1000) {
+		if s == "Europe/Berlin" {
+			t.Errorf("suggestions for %q include %q", "e", s)
+		}
+	}
+}
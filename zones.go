@@ -0,0 +1,214 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// zoneDirs are where the time package looks for the zone database
+var zoneDirs = []string{
+	"/usr/share/zoneinfo/",
+	"/usr/share/lib/zoneinfo/",
+	"/usr/lib/locale/TZ/",
+}
+
+// Zone suggestions are made for names up to maxSuggestName bytes,
+// since each is compared with every zone, and match zones containing
+// the city only when it is at least minSuggestCity bytes
+const (
+	maxSuggestName = 64
+	minSuggestCity = 3
+)
+
+var (
+	zoneNamesOnce sync.Once
+	zoneNamesList []string
+)
+
+// ZoneNames returns the names of all zones in the zone database
+func ZoneNames() []string {
+	zoneNamesOnce.Do(func() {
+		if dir := os.Getenv("ZONEINFO"); dir != "" {
+			zoneNamesList = zoneNamesFrom(dir)
+		}
+		for _, dir := range zoneDirs {
+			if len(zoneNamesList) > 0 {
+				break
+			}
+			zoneNamesList = zoneNamesFrom(dir)
+		}
+		if len(zoneNamesList) == 0 {
+			zoneNamesList = zoneNamesFrom(filepath.Join(runtime.GOROOT(), "lib", "time", "zoneinfo.zip"))
+		}
+		sort.Strings(zoneNamesList)
+	})
+	return zoneNamesList
+}
+
+// zoneNamesFrom lists the zone files in a directory or zip file
+func zoneNamesFrom(path string) (names []string) {
+	if strings.HasSuffix(path, ".zip") {
+		z, err := zip.OpenReader(path)
+		if err != nil {
+			return nil
+		}
+		defer z.Close()
+		for _, f := range z.File {
+			if !strings.HasSuffix(f.Name, "/") {
+				names = append(names, f.Name)
+			}
+		}
+		return names
+	}
+
+	magic := []byte("TZif")
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		name, _ := filepath.Rel(path, p)
+		if info.IsDir() {
+			// skip the duplicate trees some distributions ship
+			if name == "posix" || name == "right" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if name == "localtime" || name == "posixrules" || name == "Factory" {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		b := make([]byte, len(magic))
+		if _, err := io.ReadFull(f, b); err == nil && bytes.Equal(b, magic) {
+			names = append(names, filepath.ToSlash(name))
+		}
+		return nil
+	})
+	return names
+}
+
+// offsetPattern matches fixed offsets like +05:30, -0800, UTC+5 and GMT-03
+var offsetPattern = regexp.MustCompile(`^(?:UTC|GMT)?([+-])(\d{1,2})(?::?(\d{2}))?$`)
+
+// LoadZone returns the location for an IANA zone name of any
+// depth, or for a fixed offset from UTC
+func LoadZone(name string) (*time.Location, error) {
+	// a + in a query string arrives as a space
+	if strings.HasPrefix(name, " ") {
+		name = "+" + strings.TrimLeft(name, " ")
+	}
+
+	if m := offsetPattern.FindStringSubmatch(strings.ToUpper(name)); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		minutes, _ := strconv.Atoi(m[3])
+		if hours > 14 || minutes > 59 {
+			return nil, fmt.Errorf("offset %q out of range", name)
+		}
+		offset := hours*60*60 + minutes*60
+		if m[1] == "-" {
+			offset = -offset
+		}
+		if offset == 0 {
+			return time.UTC, nil
+		}
+		return time.FixedZone(fmt.Sprintf("%s%02d:%02d", m[1], hours, minutes), offset), nil
+	}
+
+	// the server's own zone isn't meaningful to a listener
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return time.LoadLocation(name)
+}
+
+// SuggestZones returns up to max zone names that look like name
+func SuggestZones(name string, max int) []string {
+	if len(name) > maxSuggestName {
+		return nil
+	}
+	want := normalizeZone(name)
+	if want == "" {
+		return nil
+	}
+	city := want[strings.LastIndex(want, "/")+1:]
+
+	type match struct {
+		name  string
+		score int
+	}
+	var matches []match
+	for _, z := range ZoneNames() {
+		have := normalizeZone(z)
+		score := editDistance(want, have)
+		if d := editDistance(city, have[strings.LastIndex(have, "/")+1:]); d < score {
+			score = d
+		}
+		if len(city) >= minSuggestCity && strings.Contains(have, city) {
+			score = 0
+		}
+		if score <= len(city)/3+1 {
+			matches = append(matches, match{z, score})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score < matches[j].score
+	})
+	var names []string
+	for i := 0; i < len(matches) && i < max; i++ {
+		names = append(names, matches[i].name)
+	}
+	return names
+}
+
+func normalizeZone(name string) string {
+	name = strings.Trim(strings.ToLower(name), "/ ")
+	return strings.Replace(name, " ", "_", -1)
+}
+
+// editDistance returns the levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}